@@ -0,0 +1,590 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	adminDefaultTimeout = 5 * time.Second
+	adminStreamBuffer   = 64
+	adminHealthInterval = 10 * time.Second
+	adminReconnectMin   = 500 * time.Millisecond
+	adminReconnectMax   = 30 * time.Second
+)
+
+var (
+	ErrAdminClosed  = errors.New("CJDNS admin connection closed")
+	ErrAdminTimeout = errors.New("CJDNS admin call timeout")
+	ErrAdminDown    = errors.New("CJDNS admin connection down")
+)
+
+const (
+	AdminEvent_DOWN  = iota // the connection died, reconnecting
+	AdminEvent_RETRY        // a reconnect attempt failed
+	AdminEvent_UP           // reconnected, handlers are being replayed
+)
+
+// AdminEvent reports an outage of the admin connection or its recovery.
+type AdminEvent struct {
+	Kind    int
+	Err     error
+	Attempt int
+	Outage  time.Duration
+}
+
+func (ev AdminEvent) String() string {
+	switch ev.Kind {
+	case AdminEvent_DOWN:
+		return fmt.Sprintf("CJDNS admin connection lost: %v", ev.Err)
+	case AdminEvent_RETRY:
+		return fmt.Sprintf("CJDNS admin reconnect attempt %d failed: %v", ev.Attempt, ev.Err)
+	case AdminEvent_UP:
+		return fmt.Sprintf("CJDNS admin connection restored after %s", ev.Outage.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("CJDNS admin event %d", ev.Kind)
+}
+
+type adminReply struct {
+	msg map[string]interface{}
+	err error
+}
+
+// AdminConfig holds what a client needs before its goroutines start.
+type AdminConfig struct {
+	MaxReplySize int // largest reply accepted in bytes, 0 means 1 MiB
+	Password     string
+	OnReconnect  func()
+	Events       func(AdminEvent)
+}
+
+// AdminClient multiplexes admin RPC calls over a single transport.
+// Every request is tagged with a txid and one reader goroutine routes
+// each reply back to the caller waiting for that txid.
+// If Password is set, calls are signed with the cjdns cookie/auth scheme.
+// A client made by DialAdminClient redials when the connection dies, then
+// runs OnReconnect; Events, if set, is told about outages and recovery.
+// Password, OnReconnect and Events come from AdminConfig and must not be
+// changed once the client runs.
+type AdminClient struct {
+	conn        AdminTransport
+	dial        func() (AdminTransport, error)
+	Timeout     time.Duration
+	Password    string
+	OnReconnect func()
+	Events      func(AdminEvent)
+
+	mu      sync.Mutex
+	wmu     sync.Mutex
+	pending map[string]chan adminReply
+	streams map[string]chan map[string]interface{}
+	prefix  string
+	seq     uint64
+	done    chan struct{}
+	closing chan struct{}
+	down    error
+	err     error
+
+	// backoff carries over between outages, so a cjdroute that keeps
+	// dying is redialed less and less often; it resets once the
+	// connection stayed up for adminReconnectMax.
+	backoff time.Duration
+	upSince time.Time
+
+	functions map[string]AdminFunction
+}
+
+func NewAdminClient(conn AdminTransport) *AdminClient {
+	return newAdminClient(conn, AdminConfig{}, nil)
+}
+
+func newAdminClient(conn AdminTransport, config AdminConfig, dial func() (AdminTransport, error)) *AdminClient {
+	ac := &AdminClient{
+		conn:        conn,
+		dial:        dial,
+		Timeout:     adminDefaultTimeout,
+		Password:    config.Password,
+		OnReconnect: config.OnReconnect,
+		Events:      config.Events,
+		pending:     make(map[string]chan adminReply),
+		streams:     make(map[string]chan map[string]interface{}),
+		prefix:      strconv.FormatUint(uint64(rand.Uint32()), 16),
+		done:        make(chan struct{}),
+		closing:     make(chan struct{}),
+	}
+	go ac.readLoop()
+	return ac
+}
+
+// DialAdminClient connects to addr (see DialAdmin) and keeps the client
+// connected: a dead or unresponsive connection is redialed with backoff.
+func DialAdminClient(addr string, config AdminConfig) (*AdminClient, error) {
+	dial := func() (AdminTransport, error) {
+		return DialAdmin(addr, config.MaxReplySize)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	ac := newAdminClient(conn, config, dial)
+	go ac.watchdog()
+	return ac, nil
+}
+
+// AdminStream receives the asynchronous messages cjdns sends with the txid
+// of a subscribing call, such as AdminLog_subscribe. C is closed when the
+// stream or the client is closed.
+type AdminStream struct {
+	ac    *AdminClient
+	txid  string
+	c     chan map[string]interface{}
+	Reply map[string]interface{}
+	C     <-chan map[string]interface{}
+}
+
+// Close stops routing messages to the stream.
+func (s *AdminStream) Close() {
+	s.ac.mu.Lock()
+	defer s.ac.mu.Unlock()
+	if c, ok := s.ac.streams[s.txid]; ok && c == s.c {
+		close(c)
+		delete(s.ac.streams, s.txid)
+	}
+}
+
+func (ac *AdminClient) nextTxid() string {
+	ac.seq++
+	return ac.prefix + "-" + strconv.FormatUint(ac.seq, 10)
+}
+
+// Call sends q with args and waits up to ac.Timeout for the matching reply.
+func (ac *AdminClient) Call(q string, args map[string]interface{}) (map[string]interface{}, error) {
+	return ac.CallTimeout(q, args, ac.Timeout)
+}
+
+// CallTimeout is like Call but with an explicit per-call timeout.
+func (ac *AdminClient) CallTimeout(q string, args map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	return ac.call(q, args, timeout, nil)
+}
+
+// Subscribe calls q and keeps routing every later message cjdns sends
+// with the same txid to the returned stream, until it is closed.
+func (ac *AdminClient) Subscribe(q string, args map[string]interface{}) (*AdminStream, error) {
+	c := make(chan map[string]interface{}, adminStreamBuffer)
+	stream := &AdminStream{ac: ac, c: c, C: c}
+	reply, err := ac.call(q, args, ac.Timeout, stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.Reply = reply
+	return stream, nil
+}
+
+func (ac *AdminClient) call(q string, args map[string]interface{}, timeout time.Duration, stream *AdminStream) (map[string]interface{}, error) {
+	message := map[string]interface{}{"q": q}
+	if args != nil {
+		message["args"] = args
+	}
+	txid, ch, err := ac.register()
+	if err != nil {
+		return nil, err
+	}
+	defer ac.forget(txid)
+	message["txid"] = txid
+	if stream != nil {
+		stream.txid = txid
+		ac.mu.Lock()
+		ac.streams[txid] = stream.c
+		ac.mu.Unlock()
+	}
+
+	if ac.Password != "" && !adminNoAuth[q] {
+		cookie, err := ac.cookie(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := signAdminMessage(message, ac.Password, cookie); err != nil {
+			return nil, err
+		}
+	}
+	return ac.roundTrip(message, ch, timeout)
+}
+
+// adminNoAuth lists the functions cjdns answers without a cookie.
+var adminNoAuth = map[string]bool{
+	"ping":   true,
+	"cookie": true,
+}
+
+func (ac *AdminClient) cookie(timeout time.Duration) (string, error) {
+	txid, ch, err := ac.register()
+	if err != nil {
+		return "", err
+	}
+	defer ac.forget(txid)
+	response, err := ac.roundTrip(map[string]interface{}{"q": "cookie", "txid": txid}, ch, timeout)
+	if err != nil {
+		return "", err
+	}
+	cookie, ok := response["cookie"].(string)
+	if !ok {
+		return "", errors.New("CJDNS cookie reply has no cookie")
+	}
+	return cookie, nil
+}
+
+// signAdminMessage turns message into an "auth" request for its original q.
+// The hash is first sha256(password + cookie) and is then replaced by the
+// sha256 of the whole bencoded request, as cjdns expects.
+func signAdminMessage(message map[string]interface{}, password string, cookie string) error {
+	message["aq"] = message["q"]
+	message["q"] = "auth"
+	message["cookie"] = cookie
+	passHash := sha256.Sum256([]byte(password + cookie))
+	message["hash"] = hex.EncodeToString(passHash[:])
+	bytes, err := bencode.EncodeBytes(message)
+	if err != nil {
+		return err
+	}
+	msgHash := sha256.Sum256(bytes)
+	message["hash"] = hex.EncodeToString(msgHash[:])
+	return nil
+}
+
+func (ac *AdminClient) register() (string, chan adminReply, error) {
+	ch := make(chan adminReply, 1)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.err != nil {
+		return "", nil, ac.err
+	}
+	if ac.down != nil {
+		return "", nil, ac.down
+	}
+	txid := ac.nextTxid()
+	ac.pending[txid] = ch
+	return txid, ch, nil
+}
+
+func (ac *AdminClient) roundTrip(message map[string]interface{}, ch chan adminReply, timeout time.Duration) (map[string]interface{}, error) {
+	bytes, err := bencode.EncodeBytes(message)
+	if err != nil {
+		return nil, err
+	}
+	ac.wmu.Lock()
+	err = ac.transport().WriteMessage(bytes)
+	ac.wmu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-ch:
+		if reply.err != nil {
+			return nil, reply.err
+		}
+		if e, ok := reply.msg["error"].(string); ok && e != "none" {
+			return reply.msg, fmt.Errorf("%s: %s", adminFunction(message), e)
+		}
+		return reply.msg, nil
+	case <-timer.C:
+		return nil, ErrAdminTimeout
+	}
+}
+
+func adminFunction(message map[string]interface{}) interface{} {
+	if aq, ok := message["aq"]; ok {
+		return aq
+	}
+	return message["q"]
+}
+
+func (ac *AdminClient) forget(txid string) {
+	ac.mu.Lock()
+	delete(ac.pending, txid)
+	ac.mu.Unlock()
+}
+
+func (ac *AdminClient) transport() AdminTransport {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.conn
+}
+
+func (ac *AdminClient) readLoop() {
+	conn := ac.transport()
+	for {
+		msg, err := conn.ReadMessage()
+		var tooLarge *BencodeTooLargeError
+		if errors.As(err, &tooLarge) {
+			ac.failCall(tooLarge.Txid, err)
+			continue
+		}
+		if err != nil {
+			conn = ac.reconnect(conn, err)
+			if conn == nil {
+				return
+			}
+			continue
+		}
+		var response map[string]interface{}
+		if err := bencode.DecodeBytes(msg, &response); err != nil {
+			fmt.Println("Error decoding admin reply:", err)
+			continue
+		}
+		ac.dispatch(response)
+	}
+}
+
+func (ac *AdminClient) dispatch(response map[string]interface{}) {
+	txid, _ := response["txid"].(string)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ch, ok := ac.pending[txid]; ok {
+		delete(ac.pending, txid)
+		select {
+		case ch <- adminReply{msg: response}:
+		default:
+		}
+		return
+	}
+	if c, ok := ac.streams[txid]; ok {
+		select {
+		case c <- response:
+		default:
+			fmt.Println("Dropping admin stream message, consumer too slow:", txid)
+		}
+		return
+	}
+	fmt.Println("Dropping admin reply with unknown txid:", txid)
+}
+
+// failCall fails the call waiting for txid with err, the connection
+// itself is still fine.
+func (ac *AdminClient) failCall(txid string, err error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ch, ok := ac.pending[txid]; ok {
+		delete(ac.pending, txid)
+		select {
+		case ch <- adminReply{err: err}:
+		default:
+		}
+		return
+	}
+	fmt.Println("Dropping admin reply for", txid, ":", err)
+}
+
+// reconnect replaces the dead transport conn, retrying with backoff until
+// it succeeds or the client is closed, in which case it returns nil.
+func (ac *AdminClient) reconnect(conn AdminTransport, err error) AdminTransport {
+	select {
+	case <-ac.closing:
+		ac.fail(ErrAdminClosed)
+		return nil
+	default:
+	}
+	if ac.dial == nil {
+		ac.fail(err)
+		return nil
+	}
+	conn.Close()
+	ac.mu.Lock()
+	ac.down = fmt.Errorf("%w: %v", ErrAdminDown, err)
+	ac.abort(ac.down)
+	ac.mu.Unlock()
+	ac.emit(AdminEvent{Kind: AdminEvent_DOWN, Err: err})
+
+	start := time.Now()
+	if ac.backoff == 0 || start.Sub(ac.upSince) > adminReconnectMax {
+		ac.backoff = adminReconnectMin
+	}
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ac.closing:
+			ac.fail(ErrAdminClosed)
+			return nil
+		case <-time.After(ac.backoff):
+		}
+		next, err := ac.dial()
+		if err == nil {
+			err = ac.probe(next)
+			if err != nil {
+				next.Close()
+			}
+		}
+		ac.backoff *= 2
+		if ac.backoff > adminReconnectMax {
+			ac.backoff = adminReconnectMax
+		}
+		if err != nil {
+			ac.emit(AdminEvent{Kind: AdminEvent_RETRY, Err: err, Attempt: attempt})
+			continue
+		}
+		ac.mu.Lock()
+		select {
+		case <-ac.closing:
+			ac.mu.Unlock()
+			next.Close()
+			ac.fail(ErrAdminClosed)
+			return nil
+		default:
+		}
+		ac.conn = next
+		ac.down = nil
+		ac.functions = nil
+		ac.mu.Unlock()
+		ac.upSince = time.Now()
+		ac.emit(AdminEvent{Kind: AdminEvent_UP, Outage: time.Since(start)})
+		if ac.OnReconnect != nil {
+			go ac.OnReconnect()
+		}
+		return next
+	}
+}
+
+// probe pings cjdroute on a freshly dialed conn before it replaces the old
+// one. Dialing UDP succeeds whether or not cjdroute listens, only a reply
+// shows that it is back.
+func (ac *AdminClient) probe(conn AdminTransport) error {
+	bytes, err := bencode.EncodeBytes(map[string]interface{}{"q": "ping", "txid": ac.prefix + "-probe"})
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(bytes); err != nil {
+		return err
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadMessage()
+		read <- err
+	}()
+	timer := time.NewTimer(ac.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-read:
+		return err
+	case <-timer.C:
+		conn.Close()
+		return ErrAdminTimeout
+	}
+}
+
+// watchdog pings cjdroute so a connection that silently stopped answering,
+// as a UDP one does when cjdroute restarts, is noticed and redialed.
+func (ac *AdminClient) watchdog() {
+	ticker := time.NewTicker(adminHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ac.closing:
+			return
+		case <-ticker.C:
+		}
+		conn := ac.transport()
+		if _, err := ac.Call("ping", nil); errors.Is(err, ErrAdminTimeout) {
+			conn.Close()
+		}
+	}
+}
+
+func (ac *AdminClient) emit(ev AdminEvent) {
+	if ac.Events != nil {
+		ac.Events(ev)
+	}
+}
+
+// fail wakes every waiting caller with err and refuses further calls.
+func (ac *AdminClient) fail(err error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.err != nil {
+		return
+	}
+	if errors.Is(err, net.ErrClosed) {
+		err = ErrAdminClosed
+	}
+	ac.err = err
+	ac.abort(err)
+	close(ac.done)
+}
+
+// abort fails every pending call and closes every stream, ac.mu is held.
+func (ac *AdminClient) abort(err error) {
+	for txid, ch := range ac.pending {
+		select {
+		case ch <- adminReply{err: err}:
+		default:
+		}
+		delete(ac.pending, txid)
+	}
+	for txid, c := range ac.streams {
+		close(c)
+		delete(ac.streams, txid)
+	}
+}
+
+// Done is closed once the reader goroutine has stopped.
+func (ac *AdminClient) Done() <-chan struct{} {
+	return ac.done
+}
+
+func (ac *AdminClient) Close() error {
+	ac.mu.Lock()
+	select {
+	case <-ac.closing:
+		ac.mu.Unlock()
+		<-ac.done
+		return nil
+	default:
+	}
+	close(ac.closing)
+	conn := ac.conn
+	ac.mu.Unlock()
+	err := conn.Close()
+	<-ac.done
+	return err
+}
+
+// CallPaged calls q with increasing "page" arguments, handing every reply
+// to fn, until cjdns stops setting "more".
+func (ac *AdminClient) CallPaged(q string, args map[string]interface{}, fn func(map[string]interface{}) error) error {
+	for page := int64(0); ; page++ {
+		pageArgs := map[string]interface{}{"page": page}
+		for k, v := range args {
+			pageArgs[k] = v
+		}
+		response, err := ac.Call(q, pageArgs)
+		if err != nil {
+			return err
+		}
+		if err := fn(response); err != nil {
+			return err
+		}
+		if more, ok := response["more"].(int64); !ok || more == 0 {
+			return nil
+		}
+	}
+}
+
+// decodeAdminReply re-encodes a decoded reply into the typed value out,
+// using out's bencode struct tags.
+func decodeAdminReply(response interface{}, out interface{}) error {
+	bytes, err := bencode.EncodeBytes(response)
+	if err != nil {
+		return err
+	}
+	return bencode.DecodeBytes(bytes, out)
+}
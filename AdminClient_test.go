@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// checkAdminAuth verifies a signed request the way cjdroute does: put
+// sha256(password + cookie) back in place of the hash, and the sha256 of
+// that bencoded request must be the hash sent.
+func checkAdminAuth(t *testing.T, message map[string]interface{}, password string) bool {
+	t.Helper()
+	sent, _ := message["hash"].(string)
+	cookie, _ := message["cookie"].(string)
+	check := make(map[string]interface{}, len(message))
+	for k, v := range message {
+		check[k] = v
+	}
+	passHash := sha256.Sum256([]byte(password + cookie))
+	check["hash"] = hex.EncodeToString(passHash[:])
+	raw, err := bencode.EncodeBytes(check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgHash := sha256.Sum256(raw)
+	return sent == hex.EncodeToString(msgHash[:])
+}
+
+func TestSignAdminMessage(t *testing.T) {
+	tests := []struct {
+		password, cookie string
+		args             map[string]interface{}
+	}{
+		{"secret", "1234567890", nil},
+		{"", "1", map[string]interface{}{"ip": "fc00::1"}},
+		{"pässwörd", "987", map[string]interface{}{"page": 2, "contentType": 258}},
+	}
+	for _, tt := range tests {
+		message := map[string]interface{}{"q": "Core_nodeInfo", "txid": "ab1"}
+		if tt.args != nil {
+			message["args"] = tt.args
+		}
+		if err := signAdminMessage(message, tt.password, tt.cookie); err != nil {
+			t.Fatal(err)
+		}
+		if message["q"] != "auth" || message["aq"] != "Core_nodeInfo" || message["cookie"] != tt.cookie {
+			t.Errorf("signed message = %v", message)
+		}
+		if !checkAdminAuth(t, message, tt.password) {
+			t.Errorf("cjdroute would reject %v signed with %q", message, tt.password)
+		}
+		if checkAdminAuth(t, message, tt.password+"x") {
+			t.Errorf("%v also verifies with the wrong password", message)
+		}
+		message["txid"] = "tampered"
+		if checkAdminAuth(t, message, tt.password) {
+			t.Errorf("%v still verifies after changing the txid", message)
+		}
+	}
+}
+
+// TestSignAdminMessageKnownAnswer pins the scheme itself rather than
+// checking signAdminMessage against a copy of it. Following cjdroute's
+// Admin.c check and the reference Python client, the request is bencoded
+// with hash = sha256(password + cookie), here
+//
+//	d2:aq29:UpperDistributor_listHandlers4:argsd4:pagei0ee6:cookie10:1384297447
+//	4:hash64:5002cb6128963374b6835c23c4136a82359e171622dc359f3e1bfa0f05154718
+//	1:q4:auth4:txid6:a1b2c3e
+//
+// and the hash sent is the sha256 of those bytes, as sha256sum prints it.
+func TestSignAdminMessageKnownAnswer(t *testing.T) {
+	tests := []struct {
+		password, cookie, txid, q string
+		args                      map[string]interface{}
+		hash                      string
+	}{
+		{"hunter2", "1384297447", "a1b2c3", "UpperDistributor_listHandlers", map[string]interface{}{"page": 0},
+			"7095561b81b49c519a8fcecaaf24ed0bf67fe94b6b820f55df8a9de9285ece9c"},
+		{"", "1384297447", "x", "Admin_asyncEnabled", nil,
+			"a0dafa66ae3d11a66a51858e2359b7d391985df4f01e6b9a044ad4543d5ed677"},
+	}
+	for _, tt := range tests {
+		message := map[string]interface{}{"q": tt.q, "txid": tt.txid}
+		if tt.args != nil {
+			message["args"] = tt.args
+		}
+		if err := signAdminMessage(message, tt.password, tt.cookie); err != nil {
+			t.Fatal(err)
+		}
+		if message["hash"] != tt.hash {
+			t.Errorf("%s signed with %q and cookie %s: hash %v, want %s", tt.q, tt.password, tt.cookie, message["hash"], tt.hash)
+		}
+	}
+}
+
+// fakeCjdroute answers cookie requests, keeps an UpperDistributor handler
+// list and records every request. A silent one records requests but never
+// answers, like a UDP port nobody serves, and ignore names a function it
+// leaves unanswered. maxHandlers, if set, caps the handler list.
+type fakeCjdroute struct {
+	t           *testing.T
+	password    string
+	silent      bool
+	ignore      string
+	maxHandlers int
+	replies     chan []byte
+	closed      chan struct{}
+	once        sync.Once
+
+	mu       sync.Mutex
+	requests []map[string]interface{}
+	handlers []HandlerEntry
+}
+
+func newFakeCjdroute(t *testing.T, password string) *fakeCjdroute {
+	return &fakeCjdroute{t: t, password: password, replies: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (f *fakeCjdroute) WriteMessage(msg []byte) error {
+	var request map[string]interface{}
+	if err := bencode.DecodeBytes(msg, &request); err != nil {
+		f.t.Errorf("client sent bad bencode: %v", err)
+		return err
+	}
+	reply := map[string]interface{}{"txid": request["txid"]}
+	q := request["q"]
+	if q == "auth" {
+		q = request["aq"]
+		if !checkAdminAuth(f.t, request, f.password) {
+			reply["error"] = "Auth failed."
+			q = nil
+		}
+	}
+	args, _ := request["args"].(map[string]interface{})
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	switch q {
+	case "cookie":
+		reply["cookie"] = "4242"
+	case "UpperDistributor_registerHandler":
+		ct, _ := args["contentType"].(int64)
+		port, _ := args["udpPort"].(int64)
+		if f.maxHandlers > 0 && len(f.handlers) >= f.maxHandlers {
+			reply["error"] = "too many handlers"
+			break
+		}
+		f.handlers = append(f.handlers, HandlerEntry{ContentType: ct, UdpPort: port})
+	case "UpperDistributor_unregisterHandler":
+		port, _ := args["udpPort"].(int64)
+		reply["error"] = "handler not found"
+		for i, entry := range f.handlers {
+			if entry.UdpPort == port {
+				f.handlers = append(f.handlers[:i:i], f.handlers[i+1:]...)
+				reply["error"] = "none"
+				break
+			}
+		}
+	case "UpperDistributor_listHandlers":
+		reply["handlers"] = append([]HandlerEntry{}, f.handlers...)
+	}
+	ignored := f.silent || q == f.ignore
+	f.mu.Unlock()
+	if ignored {
+		return nil
+	}
+	raw, err := bencode.EncodeBytes(reply)
+	if err != nil {
+		return err
+	}
+	f.replies <- raw
+	return nil
+}
+
+func (f *fakeCjdroute) ReadMessage() ([]byte, error) {
+	select {
+	case raw := <-f.replies:
+		return raw, nil
+	case <-f.closed:
+		return nil, io.EOF
+	}
+}
+
+func (f *fakeCjdroute) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func TestAdminClientSignsCalls(t *testing.T) {
+	fake := newFakeCjdroute(t, "secret")
+	ac := newAdminClient(fake, AdminConfig{Password: "secret"}, nil)
+	defer ac.Close()
+
+	if _, err := ac.Call("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ac.Call("UpperDistributor_listHandlers", map[string]interface{}{"page": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response["error"] != nil {
+		t.Fatalf("listHandlers reply = %v", response)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var queries []interface{}
+	for _, request := range fake.requests {
+		queries = append(queries, request["q"])
+	}
+	if len(queries) != 3 || queries[0] != "ping" || queries[1] != "cookie" || queries[2] != "auth" {
+		t.Fatalf("requests = %v, want ping unsigned then cookie and auth", queries)
+	}
+	if fake.requests[2]["aq"] != "UpperDistributor_listHandlers" {
+		t.Fatalf("auth request = %v", fake.requests[2])
+	}
+}
+
+func TestReconnectWaitsForPing(t *testing.T) {
+	first := newFakeCjdroute(t, "")
+	dead := newFakeCjdroute(t, "")
+	dead.silent = true
+	back := newFakeCjdroute(t, "")
+	dials := []*fakeCjdroute{dead, back}
+	dial := func() (AdminTransport, error) {
+		next := dials[0]
+		dials = dials[1:]
+		return next, nil
+	}
+	var kinds []int
+	reconnected := make(chan struct{}, 2)
+	ac := newAdminClient(first, AdminConfig{
+		Events:      func(ev AdminEvent) { kinds = append(kinds, ev.Kind) },
+		OnReconnect: func() { reconnected <- struct{}{} },
+	}, dial)
+	ac.Timeout = 100 * time.Millisecond
+	defer ac.Close()
+
+	first.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no reconnect")
+	}
+	want := []int{AdminEvent_DOWN, AdminEvent_RETRY, AdminEvent_UP}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Fatalf("events = %v, want %v", kinds, want)
+	}
+	if ac.backoff != 4*adminReconnectMin {
+		t.Fatalf("backoff after two attempts = %v, want %v", ac.backoff, 4*adminReconnectMin)
+	}
+	if _, err := ac.Call("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queries returns the functions called on f, unwrapping auth requests.
+func (f *fakeCjdroute) queries() []interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []interface{}
+	for _, request := range f.requests {
+		if request["q"] == "auth" {
+			out = append(out, request["aq"])
+		} else {
+			out = append(out, request["q"])
+		}
+	}
+	return out
+}
+
+// reorderingCjdroute holds replies until n requests are in, then sends
+// them back newest first, each echoing the "n" argument of its request.
+type reorderingCjdroute struct {
+	n       int
+	replies chan []byte
+	closed  chan struct{}
+	once    sync.Once
+
+	mu   sync.Mutex
+	held [][]byte
+}
+
+func newReorderingCjdroute(n int) *reorderingCjdroute {
+	return &reorderingCjdroute{n: n, replies: make(chan []byte, n), closed: make(chan struct{})}
+}
+
+func (f *reorderingCjdroute) WriteMessage(msg []byte) error {
+	var request map[string]interface{}
+	if err := bencode.DecodeBytes(msg, &request); err != nil {
+		return err
+	}
+	args, _ := request["args"].(map[string]interface{})
+	raw, err := bencode.EncodeBytes(map[string]interface{}{"txid": request["txid"], "n": args["n"]})
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.held = append(f.held, raw)
+	if len(f.held) == f.n {
+		for i := len(f.held) - 1; i >= 0; i-- {
+			f.replies <- f.held[i]
+		}
+		f.held = nil
+	}
+	return nil
+}
+
+func (f *reorderingCjdroute) ReadMessage() ([]byte, error) {
+	select {
+	case raw := <-f.replies:
+		return raw, nil
+	case <-f.closed:
+		return nil, io.EOF
+	}
+}
+
+func (f *reorderingCjdroute) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func TestAdminClientRoutesByTxid(t *testing.T) {
+	const calls = 8
+	ac := NewAdminClient(newReorderingCjdroute(calls))
+	defer ac.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			response, err := ac.Call("echo", map[string]interface{}{"n": i})
+			if err != nil {
+				t.Errorf("call %d: %v", i, err)
+				return
+			}
+			if got, _ := response["n"].(int64); got != i {
+				t.Errorf("call %d got the reply for call %d", i, got)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if len(ac.pending) != 0 {
+		t.Fatalf("%d calls still pending", len(ac.pending))
+	}
+}
+
+func TestAdminClientTimeoutAndLateReply(t *testing.T) {
+	ac := NewAdminClient(newReorderingCjdroute(2))
+	defer ac.Close()
+
+	start := time.Now()
+	_, err := ac.CallTimeout("echo", map[string]interface{}{"n": int64(1)}, 50*time.Millisecond)
+	if err != ErrAdminTimeout {
+		t.Fatalf("unanswered call = %v, want %v", err, ErrAdminTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout of 50ms took %v", elapsed)
+	}
+	// This call releases both replies, its own first and then the late
+	// one for the call that timed out, which must be dropped.
+	response, err := ac.Call("echo", map[string]interface{}{"n": int64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := response["n"].(int64); got != 2 {
+		t.Fatalf("call 2 got the reply for call %d", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		ac.mu.Lock()
+		pending := len(ac.pending)
+		ac.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls still pending", pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
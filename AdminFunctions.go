@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AdminArg describes one argument of an admin function as reported by
+// Admin_availableFunctions.
+type AdminArg struct {
+	Required int64  `bencode:"required"`
+	Type     string `bencode:"type"`
+}
+
+// AdminFunction maps argument names to their description.
+type AdminFunction map[string]AdminArg
+
+// AvailableFunctions returns the admin function signatures, fetching every
+// page of Admin_availableFunctions on first use and caching the result.
+func (ac *AdminClient) AvailableFunctions() (map[string]AdminFunction, error) {
+	ac.mu.Lock()
+	functions := ac.functions
+	ac.mu.Unlock()
+	if functions != nil {
+		return functions, nil
+	}
+
+	functions = make(map[string]AdminFunction)
+	err := ac.CallPaged("Admin_availableFunctions", nil, func(response map[string]interface{}) error {
+		var page struct {
+			AvailableFunctions map[string]AdminFunction `bencode:"availableFunctions"`
+		}
+		if err := decodeAdminReply(response, &page); err != nil {
+			return err
+		}
+		for name, fn := range page.AvailableFunctions {
+			functions[name] = fn
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ac.mu.Lock()
+	ac.functions = functions
+	ac.mu.Unlock()
+	return functions, nil
+}
+
+// parseCallArgs turns name=value pairs into admin call arguments, checking
+// them against fn. Int values must be integers, Dict and List values are
+// given as JSON.
+func parseCallArgs(fn AdminFunction, pairs []string) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("argument %q is not name=value", pair)
+		}
+		arg, ok := fn[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown argument %q, expected one of %s", name, strings.Join(fn.argNames(), ", "))
+		}
+		switch arg.Type {
+		case "Int":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("argument %q must be an Int: %v", name, err)
+			}
+			args[name] = n
+		case "String":
+			args[name] = value
+		case "Dict", "List":
+			var v interface{}
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				return nil, fmt.Errorf("argument %q must be a JSON %s: %v", name, arg.Type, err)
+			}
+			v = jsonToBencode(v)
+			if _, isDict := v.(map[string]interface{}); arg.Type == "Dict" && !isDict {
+				return nil, fmt.Errorf("argument %q must be a JSON Dict", name)
+			}
+			if _, isList := v.([]interface{}); arg.Type == "List" && !isList {
+				return nil, fmt.Errorf("argument %q must be a JSON List", name)
+			}
+			args[name] = v
+		default:
+			return nil, fmt.Errorf("argument %q has unsupported type %s", name, arg.Type)
+		}
+	}
+	for name, arg := range fn {
+		if _, ok := args[name]; !ok && arg.Required != 0 {
+			return nil, fmt.Errorf("missing required argument %q (%s)", name, arg.Type)
+		}
+	}
+	return args, nil
+}
+
+func (fn AdminFunction) argNames() []string {
+	names := make([]string, 0, len(fn))
+	for name := range fn {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonToBencode converts JSON numbers to int64, bencode has no floats.
+func jsonToBencode(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonToBencode(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonToBencode(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
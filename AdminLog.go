@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// cjdns drops async messages for admin clients that stay silent for too
+// long, so a subscription is kept alive by pinging.
+var adminLogKeepAlive = 5 * time.Second
+
+// LogFilter selects which cjdns log messages AdminLog_subscribe delivers.
+// Empty fields match everything.
+type LogFilter struct {
+	Level string
+	File  string
+	Line  int64
+}
+
+// LogMessage is one async message of an AdminLog subscription.
+type LogMessage struct {
+	Level    string `bencode:"level"`
+	File     string `bencode:"file"`
+	Line     int64  `bencode:"line"`
+	Message  string `bencode:"message"`
+	Time     int64  `bencode:"time"`
+	StreamId string `bencode:"streamId"`
+}
+
+func (lm LogMessage) String() string {
+	return fmt.Sprintf("cjdns %s %s:%d %s", lm.Level, lm.File, lm.Line, lm.Message)
+}
+
+func (lf LogFilter) args() map[string]interface{} {
+	args := map[string]interface{}{}
+	if lf.Level != "" {
+		args["level"] = lf.Level
+	}
+	if lf.File != "" {
+		args["file"] = lf.File
+	}
+	if lf.Line != 0 {
+		args["line"] = lf.Line
+	}
+	return args
+}
+
+// streamLogs subscribes to the cjdns log with filter and hands every
+// message to fn until stop is closed or the admin client is closed. While
+// the admin connection is down it waits, then subscribes again, since a
+// restarted cjdroute has forgotten the old subscription. A keep-alive that
+// times out may have lost the subscription too, so it also resubscribes.
+func streamLogs(filter LogFilter, fn func(LogMessage), stop <-chan struct{}) error {
+	if cjdns.Admin == nil {
+		return errors.New("CJDNS connection is nil")
+	}
+	for {
+		err := followLogs(filter, fn, stop)
+		if !errors.Is(err, ErrAdminDown) && !errors.Is(err, ErrAdminTimeout) {
+			return err
+		}
+		select {
+		case <-time.After(adminReconnectMin):
+		case <-cjdns.Admin.Done():
+			return ErrAdminClosed
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// followLogs runs one AdminLog subscription, it returns an ErrAdminDown
+// error when the connection drops and ErrAdminTimeout when a keep-alive
+// goes unanswered.
+func followLogs(filter LogFilter, fn func(LogMessage), stop <-chan struct{}) error {
+	stream, err := cjdns.Admin.Subscribe("AdminLog_subscribe", filter.args())
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	streamId, _ := stream.Reply["streamId"].(string)
+	defer cjdns.Admin.Call("AdminLog_unsubscribe", map[string]interface{}{"streamId": streamId})
+
+	ticker := time.NewTicker(adminLogKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-stream.C:
+			if !ok {
+				select {
+				case <-cjdns.Admin.Done():
+					return ErrAdminClosed
+				default:
+					return ErrAdminDown
+				}
+			}
+			var lm LogMessage
+			if err := decodeAdminReply(msg, &lm); err != nil {
+				fmt.Println("Error decoding cjdns log message:", err)
+				continue
+			}
+			fn(lm)
+		case <-ticker.C:
+			if _, err := cjdns.Admin.Call("ping", nil); err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// subscribed waits for f to receive an AdminLog_subscribe and returns its txid.
+func subscribed(t *testing.T, f *fakeCjdroute) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.mu.Lock()
+		for _, request := range f.requests {
+			if request["q"] == "AdminLog_subscribe" {
+				f.mu.Unlock()
+				return request["txid"].(string)
+			}
+		}
+		f.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no AdminLog_subscribe sent")
+	return ""
+}
+
+func TestStreamLogsResubscribes(t *testing.T) {
+	first := newFakeCjdroute(t, "")
+	second := newFakeCjdroute(t, "")
+	ac := newAdminClient(first, AdminConfig{}, func() (AdminTransport, error) { return second, nil })
+	saved := cjdns.Admin
+	cjdns.Admin = ac
+	defer func() { cjdns.Admin = saved }()
+
+	got := make(chan LogMessage, 1)
+	stop := make(chan struct{})
+	ended := make(chan error, 1)
+	go func() {
+		ended <- streamLogs(LogFilter{Level: "INFO"}, func(lm LogMessage) { got <- lm }, stop)
+	}()
+
+	subscribed(t, first)
+	first.Close()
+	txid := subscribed(t, second)
+	raw, err := bencode.EncodeBytes(map[string]interface{}{"txid": txid, "level": "INFO", "message": "back"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.replies <- raw
+	select {
+	case lm := <-got:
+		if lm.Message != "back" {
+			t.Fatalf("log message = %v", lm)
+		}
+	case err := <-ended:
+		t.Fatalf("streamLogs ended after reconnect: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no log message after reconnect")
+	}
+
+	ac.Close()
+	select {
+	case err := <-ended:
+		if err != ErrAdminClosed {
+			t.Fatalf("streamLogs ended with %v, want %v", err, ErrAdminClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("streamLogs did not end after Close")
+	}
+}
+
+func TestStreamLogsResubscribesAfterTimeout(t *testing.T) {
+	keepAlive := adminLogKeepAlive
+	adminLogKeepAlive = 20 * time.Millisecond
+	defer func() { adminLogKeepAlive = keepAlive }()
+	fake := newFakeCjdroute(t, "")
+	fake.ignore = "ping"
+	ac := NewAdminClient(fake)
+	ac.Timeout = 50 * time.Millisecond
+	saved := cjdns.Admin
+	cjdns.Admin = ac
+	defer func() { cjdns.Admin = saved }()
+
+	stop := make(chan struct{})
+	ended := make(chan error, 1)
+	go func() {
+		ended <- streamLogs(LogFilter{}, func(LogMessage) {}, stop)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for subscribes := 0; subscribes < 2; {
+		select {
+		case err := <-ended:
+			t.Fatalf("streamLogs ended after a keep-alive timeout: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no new subscription after a keep-alive timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+		subscribes = 0
+		for _, q := range fake.queries() {
+			if q == "AdminLog_subscribe" {
+				subscribes++
+			}
+		}
+	}
+	close(stop)
+	if err := <-ended; err != nil {
+		t.Fatalf("streamLogs ended with %v after stop", err)
+	}
+	ac.Close()
+}
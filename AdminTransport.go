@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	adminUDPDefaultAddr     = "127.0.0.1:11234"
+	adminMaxDatagram        = 65535
+	adminDefaultMaxReadSize = 1 << 20
+)
+
+// AdminTransport carries whole bencoded admin messages to and from cjdroute.
+type AdminTransport interface {
+	WriteMessage(msg []byte) error
+	ReadMessage() ([]byte, error)
+	Close() error
+}
+
+// DialAdmin connects to the cjdns admin interface at addr, which is either
+// unix:///path/to/cjdroute.sock, udp://host:port or a bare socket path.
+// Replies larger than maxSize bytes are refused, 0 means the default.
+func DialAdmin(addr string, maxSize int) (AdminTransport, error) {
+	if maxSize <= 0 {
+		maxSize = adminDefaultMaxReadSize
+	}
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		hostPort := strings.TrimPrefix(addr, "udp://")
+		if hostPort == "" {
+			hostPort = adminUDPDefaultAddr
+		}
+		rAddr, err := net.ResolveUDPAddr("udp", hostPort)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.DialUDP("udp", nil, rAddr)
+		if err != nil {
+			return nil, err
+		}
+		return &udpAdminTransport{conn: conn, maxSize: maxSize}, nil
+	case strings.HasPrefix(addr, "unix://"):
+		return dialUnixAdmin(strings.TrimPrefix(addr, "unix://"), maxSize)
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("unsupported admin address %q", addr)
+	default:
+		return dialUnixAdmin(addr, maxSize)
+	}
+}
+
+func dialUnixAdmin(path string, maxSize int) (AdminTransport, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &unixAdminTransport{conn: conn, reader: NewBencodeReader(conn, maxSize)}, nil
+}
+
+// unixAdminTransport is a stream, replies are framed by BencodeReader.
+type unixAdminTransport struct {
+	conn   net.Conn
+	reader *BencodeReader
+}
+
+func (t *unixAdminTransport) WriteMessage(msg []byte) error {
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+func (t *unixAdminTransport) ReadMessage() ([]byte, error) {
+	return t.reader.ReadValue()
+}
+
+func (t *unixAdminTransport) Close() error {
+	return t.conn.Close()
+}
+
+// udpAdminTransport relies on cjdroute answering every request with a
+// single datagram, so each read yields exactly one message.
+type udpAdminTransport struct {
+	conn    *net.UDPConn
+	buf     []byte
+	maxSize int
+}
+
+func (t *udpAdminTransport) WriteMessage(msg []byte) error {
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+func (t *udpAdminTransport) ReadMessage() ([]byte, error) {
+	if t.buf == nil {
+		t.buf = make([]byte, adminMaxDatagram)
+	}
+	n, err := t.conn.Read(t.buf)
+	if err != nil {
+		return nil, err
+	}
+	if n > t.maxSize {
+		return nil, tooLargeDatagram(t.buf[:n], t.maxSize)
+	}
+	return append([]byte(nil), t.buf[:n]...), nil
+}
+
+// tooLargeDatagram is the error for an oversized reply, naming its txid
+// so that only the call waiting for it fails.
+func tooLargeDatagram(datagram []byte, maxSize int) error {
+	_, err := NewBencodeReader(bytes.NewReader(datagram), maxSize).ReadValue()
+	var tooLarge *BencodeTooLargeError
+	if !errors.As(err, &tooLarge) {
+		tooLarge = &BencodeTooLargeError{Size: len(datagram)}
+	}
+	return tooLarge
+}
+
+func (t *udpAdminTransport) Close() error {
+	return t.conn.Close()
+}
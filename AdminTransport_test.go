@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+// oversizedReply answers a "big" call with a reply of size bytes and
+// anything else with an empty one.
+func oversizedReply(t *testing.T, msg []byte, size int) []byte {
+	var request map[string]interface{}
+	if err := bencode.DecodeBytes(msg, &request); err != nil {
+		t.Errorf("client sent bad bencode: %v", err)
+		return nil
+	}
+	reply := map[string]interface{}{"txid": request["txid"]}
+	if request["q"] == "big" {
+		reply["peers"] = strings.Repeat("x", size)
+	}
+	raw, err := bencode.EncodeBytes(reply)
+	if err != nil {
+		t.Error(err)
+	}
+	return raw
+}
+
+// checkTooLarge makes a call whose reply is over the limit and one after
+// it, only the first may fail.
+func checkTooLarge(t *testing.T, name string, ac *AdminClient) {
+	_, err := ac.Call("big", nil)
+	var tooLarge *BencodeTooLargeError
+	if !errors.Is(err, ErrBencodeTooLarge) || !errors.As(err, &tooLarge) {
+		t.Errorf("%s: oversized reply gave %v, want %v", name, err, ErrBencodeTooLarge)
+	}
+	if _, err := ac.Call("ping", nil); err != nil {
+		t.Errorf("%s: call after an oversized reply: %v", name, err)
+	}
+}
+
+func TestAdminReplyTooLarge(t *testing.T) {
+	const maxSize = 256
+
+	path := filepath.Join(t.TempDir(), "cjdroute.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := NewBencodeReader(conn, 1<<20)
+		for {
+			msg, err := br.ReadValue()
+			if err != nil {
+				return
+			}
+			conn.Write(oversizedReply(t, msg, 4*maxSize))
+		}
+	}()
+	conn, err := DialAdmin("unix://"+path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := NewAdminClient(conn)
+	checkTooLarge(t, "unix", ac)
+	ac.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, adminMaxDatagram)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(oversizedReply(t, buf[:n], 4*maxSize), addr)
+		}
+	}()
+	conn, err = DialAdmin("udp://"+pc.LocalAddr().String(), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac = NewAdminClient(conn)
+	checkTooLarge(t, "udp", ac)
+	ac.Close()
+}
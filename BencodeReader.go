@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+var ErrBencodeTooLarge = errors.New("bencode value exceeds maximum size")
+
+// BencodeTooLargeError reports a value larger than the limit, with the
+// txid of its top level dictionary if it has one.
+type BencodeTooLargeError struct {
+	Size int
+	Txid string
+}
+
+func (e *BencodeTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d bytes", ErrBencodeTooLarge, e.Size)
+}
+
+func (e *BencodeTooLargeError) Unwrap() error {
+	return ErrBencodeTooLarge
+}
+
+const (
+	// bencodeMaxDigits bounds integers and string lengths, which are
+	// still parsed while an oversized value is skipped.
+	bencodeMaxDigits = 20
+	// bencodeMaxKept is the longest string still read, rather than
+	// discarded, while skipping, enough for a dictionary key or txid.
+	bencodeMaxKept = 64
+)
+
+// BencodeReader reads whole bencode values off a stream, however many
+// reads each one takes, refusing values larger than MaxSize bytes.
+type BencodeReader struct {
+	r       *bufio.Reader
+	MaxSize int
+}
+
+func NewBencodeReader(r io.Reader, maxSize int) *BencodeReader {
+	return &BencodeReader{r: bufio.NewReader(r), MaxSize: maxSize}
+}
+
+// ReadValue returns the raw bytes of the next bencode value. A value larger
+// than MaxSize is read to its end without keeping it and reported as a
+// *BencodeTooLargeError, the reader stays usable. After any other error
+// the stream position is undefined and the reader should be dropped.
+func (br *BencodeReader) ReadValue() ([]byte, error) {
+	var out []byte
+	size := 0
+	depth := 0
+	dict := false
+	items := 0 // values completed inside the top level container
+	var key, txid string
+	for {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && size > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		size++
+		token := []byte{b}
+		var str []byte
+		switch {
+		case b == 'i':
+			digits, err := br.readUntil('e')
+			if err != nil {
+				return nil, err
+			}
+			token = append(token, digits...)
+		case b >= '0' && b <= '9':
+			digits, err := br.readUntil(':')
+			if err != nil {
+				return nil, err
+			}
+			token = append(token, digits...)
+			n, err := strconv.Atoi(string(token[:len(token)-1]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad bencode string length %q", token[:len(token)-1])
+			}
+			if size+len(digits)+n > br.MaxSize && n > bencodeMaxKept {
+				if _, err := io.CopyN(ioutil.Discard, br.r, int64(n)); err != nil {
+					return nil, noEOF(err)
+				}
+				size += n
+				break
+			}
+			str = make([]byte, n)
+			if _, err := io.ReadFull(br.r, str); err != nil {
+				return nil, noEOF(err)
+			}
+			token = append(token, str...)
+		case b == 'l' || b == 'd':
+			dict = dict || depth == 0 && b == 'd'
+			depth++
+		case b == 'e' && depth > 0:
+			depth--
+		default:
+			return nil, fmt.Errorf("unexpected byte %q in bencode stream", b)
+		}
+		size += len(token) - 1
+		if size <= br.MaxSize {
+			out = append(out, token...)
+		}
+		if depth == 1 && b != 'l' && b != 'd' {
+			if dict && str != nil {
+				if items%2 == 0 {
+					key = string(str)
+				} else if key == "txid" {
+					txid = string(str)
+				}
+			}
+			items++
+		}
+		if depth == 0 {
+			if size > br.MaxSize {
+				return nil, &BencodeTooLargeError{Size: size, Txid: txid}
+			}
+			return out, nil
+		}
+	}
+}
+
+// readUntil returns the digits up to and including delim.
+func (br *BencodeReader) readUntil(delim byte) ([]byte, error) {
+	var out []byte
+	for {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		out = append(out, b)
+		if b == delim {
+			return out, nil
+		}
+		if (b < '0' || b > '9') && b != '-' {
+			return nil, fmt.Errorf("unexpected byte %q in bencode number", b)
+		}
+		if len(out) > bencodeMaxDigits {
+			return nil, fmt.Errorf("bencode number longer than %d digits", bencodeMaxDigits)
+		}
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBencodeReaderFraming(t *testing.T) {
+	values := []string{
+		"d4:txid2:ab5:errori-3ee",
+		"l5:helloi0ed1:al0:eee",
+		"i42e",
+		"0:",
+		"d1:q4:ping3:buf10:0123456789e",
+	}
+	stream := strings.Join(values, "")
+	for name, r := range map[string]io.Reader{
+		"whole":    strings.NewReader(stream),
+		"one byte": iotest.OneByteReader(strings.NewReader(stream)),
+	} {
+		br := NewBencodeReader(r, 64)
+		for _, want := range values {
+			got, err := br.ReadValue()
+			if err != nil || string(got) != want {
+				t.Fatalf("%s: ReadValue() = %q, %v, want %q", name, got, err, want)
+			}
+		}
+		if got, err := br.ReadValue(); err != io.EOF {
+			t.Fatalf("%s: ReadValue() at end = %q, %v, want io.EOF", name, got, err)
+		}
+	}
+}
+
+func TestBencodeReaderErrors(t *testing.T) {
+	tests := []struct {
+		in      string
+		maxSize int
+		err     error
+	}{
+		{"d4:txid", 64, io.ErrUnexpectedEOF},
+		{"d4:tx", 64, io.ErrUnexpectedEOF},
+		{"i12", 64, io.ErrUnexpectedEOF},
+		{"l", 64, io.ErrUnexpectedEOF},
+		{"d3:buf20:01234567890123456789e", 16, ErrBencodeTooLarge},
+		{"99999999999:x", 64, io.ErrUnexpectedEOF},
+		{"i123456789012345678901e", 64, nil},
+		{"li1ei2ei3ei4ei5ee", 8, ErrBencodeTooLarge},
+		{"e", 64, nil},
+		{"x", 64, nil},
+		{"i1x2e", 64, nil},
+		{"3x:abc", 64, nil},
+	}
+	for _, tt := range tests {
+		br := NewBencodeReader(strings.NewReader(tt.in), tt.maxSize)
+		got, err := br.ReadValue()
+		if err == nil {
+			t.Errorf("ReadValue(%q) = %q, want error", tt.in, got)
+			continue
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("ReadValue(%q) error = %v, want %v", tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestBencodeReaderSkipsTooLarge(t *testing.T) {
+	big := strings.Repeat("x", 200)
+	tests := []struct {
+		in   string
+		txid string
+	}{
+		{"d5:error4:none5:peersl200:" + big + "e4:txid3:abce", "abc"},
+		{"d4:txid3:abc5:peers200:" + big + "e", "abc"},
+		{"d1:ad4:txid6:nested1:y200:" + big + "e4:txid2:oke", "ok"},
+		{"l4:txid3:abc200:" + big + "e", ""},
+		{"200:" + big, ""},
+		{"d4:txidi7e1:x200:" + big + "e", ""},
+	}
+	for _, tt := range tests {
+		br := NewBencodeReader(strings.NewReader(tt.in+"d4:txid4:nexte"), 64)
+		got, err := br.ReadValue()
+		var tooLarge *BencodeTooLargeError
+		if !errors.As(err, &tooLarge) || !errors.Is(err, ErrBencodeTooLarge) {
+			t.Errorf("ReadValue(%.30q...) = %q, %v, want a BencodeTooLargeError", tt.in, got, err)
+			continue
+		}
+		if tooLarge.Txid != tt.txid || tooLarge.Size != len(tt.in) {
+			t.Errorf("ReadValue(%.30q...) error = %+v, want txid %q and size %d", tt.in, tooLarge, tt.txid, len(tt.in))
+		}
+		if got, err := br.ReadValue(); err != nil || string(got) != "d4:txid4:nexte" {
+			t.Errorf("after %.30q... ReadValue() = %q, %v, want the next value", tt.in, got, err)
+		}
+	}
+}
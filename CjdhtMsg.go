@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	CJDHT_PING      = "pn"
+	CJDHT_GET_PEERS = "gp"
+	CJDHT_FIND_NODE = "fn"
+
+	// A packed node is a 32 byte key followed by an 8 byte label.
+	cjdhtNodeSize = 32 + 8
+)
+
+var cjdhtQueryNames = map[string]string{
+	CJDHT_PING:      "PING",
+	CJDHT_GET_PEERS: "GET_PEERS",
+	CJDHT_FIND_NODE: "FIND_NODE",
+}
+
+// DhtNode is one entry of the packed "n" list, with its version from "np".
+type DhtNode struct {
+	PublicKey string
+	Label     Label
+	Version   int64
+}
+
+// IP is the cjdns address of the node's key.
+func (n DhtNode) IP() (net.IP, error) {
+	return publicKeyToIP6(n.PublicKey)
+}
+
+// CjdhtMsg is a router DHT message, a query when Query is set and a reply
+// otherwise. Keys it does not model are kept in Extra.
+type CjdhtMsg struct {
+	Query   string
+	Txid    string
+	Version int64
+	// Target is the 8 byte label asked about by getPeers, or the 16 byte
+	// address asked about by findNode.
+	Target         []byte
+	EncodingScheme EncodingScheme
+	// EncodingIndex is the form number of the link the sender was reached
+	// over, -1 when absent.
+	EncodingIndex int64
+	Nodes         []DhtNode
+	Extra         map[string]interface{}
+}
+
+// NewCjdhtQuery builds a query of type q with a fresh txid.
+func NewCjdhtQuery(q string, target []byte) *CjdhtMsg {
+	return &CjdhtMsg{
+		Query:          q,
+		Txid:           fmt.Sprintf("%08x", generateRandomNumber()),
+		Version:        defaultRouteVersion,
+		Target:         target,
+		EncodingScheme: SchemeV358,
+		EncodingIndex:  -1,
+	}
+}
+
+// TargetLabel is Target as a label, for getPeers.
+func (m *CjdhtMsg) TargetLabel() (Label, bool) {
+	if len(m.Target) != 8 {
+		return 0, false
+	}
+	return Label(binary.BigEndian.Uint64(m.Target)), true
+}
+
+// TargetIP is Target as an address, for findNode.
+func (m *CjdhtMsg) TargetIP() (net.IP, bool) {
+	if len(m.Target) != net.IPv6len {
+		return nil, false
+	}
+	return net.IP(m.Target), true
+}
+
+// LabelTarget returns the getPeers Target for l.
+func LabelTarget(l Label) []byte {
+	target := make([]byte, 8)
+	binary.BigEndian.PutUint64(target, uint64(l))
+	return target
+}
+
+func cjdhtQueryString(q string) string {
+	if name, ok := cjdhtQueryNames[q]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN[%s]", q)
+}
+
+func (m *CjdhtMsg) String() string {
+	kind := "REPLY"
+	if m.Query != "" {
+		kind = cjdhtQueryString(m.Query)
+	}
+	out := fmt.Sprintf("CJDHT %s txid %x version %d", kind, m.Txid, m.Version)
+	if l, ok := m.TargetLabel(); ok {
+		out += " target " + l.String()
+	} else if ip, ok := m.TargetIP(); ok {
+		out += " target " + ip.String()
+	}
+	var nodes []string
+	for _, n := range m.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s@%s v%d", n.PublicKey, n.Label, n.Version))
+	}
+	if len(nodes) > 0 {
+		out += " nodes [" + strings.Join(nodes, ", ") + "]"
+	}
+	return out
+}
+
+// parseCjdht decodes the bencoded content of a ContentType_CJDHT message.
+func parseCjdht(content []byte) (*CjdhtMsg, error) {
+	var dict map[string]interface{}
+	if err := bencode.DecodeBytes(content, &dict); err != nil {
+		return nil, decodeErr("CJDHT", ErrBadPayload, "%v", err)
+	}
+	msg := &CjdhtMsg{EncodingIndex: -1, Extra: make(map[string]interface{})}
+	var packed, versions string
+	hasVersions := false
+	for key, value := range dict {
+		var ok bool
+		switch key {
+		case "q":
+			msg.Query, ok = value.(string)
+		case "txid":
+			msg.Txid, ok = value.(string)
+		case "p":
+			msg.Version, ok = value.(int64)
+		case "tar":
+			var target string
+			target, ok = value.(string)
+			msg.Target = []byte(target)
+		case "ei":
+			msg.EncodingIndex, ok = value.(int64)
+		case "es":
+			var es string
+			if es, ok = value.(string); ok {
+				var err error
+				if msg.EncodingScheme, err = DecodeEncodingScheme([]byte(es)); err != nil {
+					return nil, decodeErr("CJDHT", ErrBadPayload, "es: %v", err)
+				}
+			}
+		case "n":
+			packed, ok = value.(string)
+		case "np":
+			versions, ok = value.(string)
+			hasVersions = true
+		default:
+			msg.Extra[key], ok = value, true
+		}
+		if !ok {
+			return nil, decodeErr("CJDHT", ErrBadPayload, "%q has type %T", key, value)
+		}
+	}
+	if len(packed)%cjdhtNodeSize != 0 {
+		return nil, decodeErr("CJDHT", ErrBadPayload, "n of %d bytes", len(packed))
+	}
+	count := len(packed) / cjdhtNodeSize
+	var width int
+	if hasVersions {
+		if len(versions) == 0 {
+			return nil, decodeErr("CJDHT", ErrBadPayload, "np is empty")
+		}
+		width = int(versions[0])
+		if width < 1 || width > 4 || len(versions)-1 != width*count {
+			return nil, decodeErr("CJDHT", ErrBadPayload, "np of %d bytes for %d nodes", len(versions), count)
+		}
+	}
+	for i := 0; i < count; i++ {
+		node := packed[i*cjdhtNodeSize : (i+1)*cjdhtNodeSize]
+		n := DhtNode{
+			PublicKey: keyBytesToString([]byte(node[:32])),
+			Label:     Label(binary.BigEndian.Uint64([]byte(node[32:]))),
+		}
+		for j := 0; j < width; j++ {
+			n.Version = n.Version<<8 | int64(versions[1+i*width+j])
+		}
+		msg.Nodes = append(msg.Nodes, n)
+	}
+	return msg, nil
+}
+
+// encode bencodes msg for the wire. Node versions are packed one byte
+// each unless one of them needs more.
+func (msg *CjdhtMsg) encode() ([]byte, error) {
+	dict := make(map[string]interface{}, len(msg.Extra)+8)
+	for key, value := range msg.Extra {
+		dict[key] = value
+	}
+	if msg.Query != "" {
+		dict["q"] = msg.Query
+	}
+	if msg.Txid != "" {
+		dict["txid"] = msg.Txid
+	}
+	if msg.Version != 0 {
+		dict["p"] = msg.Version
+	}
+	if msg.Target != nil {
+		dict["tar"] = string(msg.Target)
+	}
+	if msg.EncodingIndex >= 0 {
+		dict["ei"] = msg.EncodingIndex
+	}
+	if msg.EncodingScheme != nil {
+		if err := msg.EncodingScheme.Validate(); err != nil {
+			return nil, err
+		}
+		dict["es"] = string(msg.EncodingScheme.Serialize())
+	}
+	if msg.Nodes != nil {
+		packed := make([]byte, 0, len(msg.Nodes)*cjdhtNodeSize)
+		width := 1
+		for _, n := range msg.Nodes {
+			key, err := Base32_decode(strings.TrimSuffix(n.PublicKey, ".k"))
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("CJDHT node has a bad key %q", n.PublicKey)
+			}
+			packed = append(packed, key...)
+			packed = append(packed, LabelTarget(n.Label)...)
+			for n.Version>>(8*uint(width)) != 0 && width < 4 {
+				width++
+			}
+		}
+		versions := []byte{byte(width)}
+		for _, n := range msg.Nodes {
+			for j := width - 1; j >= 0; j-- {
+				versions = append(versions, byte(n.Version>>(8*uint(j))))
+			}
+		}
+		dict["n"] = string(packed)
+		dict["np"] = string(versions)
+	}
+	return bencode.EncodeBytes(dict)
+}
+
+// createCjdhtMessage wraps msg in the headers for dest.
+func createCjdhtMessage(dest Destination, msg *CjdhtMsg) ([]byte, error) {
+	content, err := msg.encode()
+	if err != nil {
+		return nil, err
+	}
+	message := Message{
+		RouteHeader: RouteHeader{
+			PublicKey: dest.PublicKey,
+			Version:   dest.Version,
+			IP:        net.ParseIP(dest.IP),
+			SwitchHeader: SwitchHeader{
+				Label:   dest.Label,
+				Version: currentVer,
+			},
+		},
+		DataHeader: DataHeader{
+			ContentType: ContentType_CJDHT,
+			Version:     1,
+		},
+		ContentBytes: content,
+	}
+	return message.encode()
+}
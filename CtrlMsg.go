@@ -6,6 +6,125 @@ import (
 	"fmt"
 )
 
+const (
+	CtrlHeaderSize = 4
+
+	CTRL_ERROR          = 2
+	CTRL_PING           = 3
+	CTRL_PONG           = 4
+	CTRL_KEYPING        = 5
+	CTRL_KEYPONG        = 6
+	CTRL_GETSNODE_QUERY = 7
+	CTRL_GETSNODE_REPLY = 8
+	CTRL_RPATH_QUERY    = 9
+	CTRL_RPATH_REPLY    = 10
+
+	CTRL_PING_MAGIC           = 0x09f91102
+	CTRL_PONG_MAGIC           = 0x9d74e35b
+	CTRL_KEYPING_MAGIC        = 0x01234567
+	CTRL_KEYPONG_MAGIC        = 0x89abcdef
+	CTRL_GETSNODE_QUERY_MAGIC = 0x736e6fa1
+	CTRL_GETSNODE_REPLY_MAGIC = 0x736e6f72
+	CTRL_RPATH_QUERY_MAGIC    = 0x736b7071
+	CTRL_RPATH_REPLY_MAGIC    = 0x736b7072
+
+	ctrlErrorMinSize    = 4 + SwitchHeaderSize + 4
+	ctrlPingMinSize     = 8
+	ctrlKeyPingMinSize  = 8 + 32
+	ctrlGetSnodeSize    = 4 + 4 + 4 + 4 + 32 + 8
+	ctrlRPathSize       = 4 + 4 + 8
+	ctrlPingMaxDataSize = 256
+)
+
+var ctrlTypeNames = map[uint16]string{
+	CTRL_ERROR:          "ERROR",
+	CTRL_PING:           "PING",
+	CTRL_PONG:           "PONG",
+	CTRL_KEYPING:        "KEYPING",
+	CTRL_KEYPONG:        "KEYPONG",
+	CTRL_GETSNODE_QUERY: "GETSNODE_QUERY",
+	CTRL_GETSNODE_REPLY: "GETSNODE_REPLY",
+	CTRL_RPATH_QUERY:    "RPATH_QUERY",
+	CTRL_RPATH_REPLY:    "RPATH_REPLY",
+}
+
+var ctrlErrorNames = []string{
+	"NONE",
+	"MALFORMED_ADDRESS",
+	"FLOOD",
+	"LINK_LIMIT_EXCEEDED",
+	"OVERSIZE_MESSAGE",
+	"UNDERSIZE_MESSAGE",
+	"AUTHENTICATION",
+	"INVALID",
+	"UNDELIVERABLE",
+	"LOOP_ROUTE",
+	"RETURN_PATH_INVALID",
+}
+
+// CtrlMsg is a decoded switch control frame, it is the Content of a
+// Message whose RouteHeader.IsCtrl is set. Exactly one of the typed
+// bodies is filled, according to Type.
+type CtrlMsg struct {
+	Type     uint16
+	TypeName string
+	Endian   string
+	Error    *CtrlError
+	Ping     *CtrlPing
+	GetSnode *CtrlGetSnode
+	RPath    *CtrlRPath
+}
+
+// CtrlError reports why a packet was dropped, Cause is the switch header
+// of that packet.
+type CtrlError struct {
+	ErrorType  uint32
+	ErrorName  string
+	Cause      SwitchHeader
+	Nonce      uint32
+	Additional []byte
+}
+
+// CtrlPing is the body of PING, PONG, KEYPING and KEYPONG, Key is only
+// set for the KEY variants.
+type CtrlPing struct {
+	Magic   uint32
+	Version uint32
+	Key     string
+	Data    []byte
+}
+
+// CtrlGetSnode asks a node for its supernode, or carries the answer.
+type CtrlGetSnode struct {
+	Magic        uint32
+	Version      uint32
+	SendKbps     uint32
+	SnodeVersion uint32
+	SnodeKey     string
+	PathToSnode  uint64
+}
+
+// CtrlRPath asks for, or returns, the reverse path to the sender.
+type CtrlRPath struct {
+	Magic   uint32
+	Version uint32
+	RPath   uint64
+}
+
+func ctrlTypeString(typ uint16) string {
+	if name, ok := ctrlTypeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", typ)
+}
+
+func ctrlErrorString(errorType uint32) string {
+	if int(errorType) < len(ctrlErrorNames) {
+		return ctrlErrorNames[errorType]
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", errorType)
+}
+
 func netChecksumRaw(buf []byte) uint16 {
 	// Checksum pairs.
 	var state uint32
@@ -40,8 +159,9 @@ func netChecksumRaw(buf []byte) uint16 {
 }
 
 func parseCtrl(bytes []byte) (out interface{}, err error) {
-	//if (bytes.length < MINSIZE) { throw new Error("runt"); }
-	// We don't have 1s complement in js so we can't check this, ignore...
+	if len(bytes) < CtrlHeaderSize {
+		return nil, decodeErr("CTRL", ErrRunt, "%d bytes", len(bytes))
+	}
 	checksum := uint16(bytes[0])<<8 | uint16(bytes[1])
 	bytes[0], bytes[1] = 0, 0
 	realChecksum := netChecksumRaw(bytes)
@@ -51,20 +171,221 @@ func parseCtrl(bytes []byte) (out interface{}, err error) {
 		if realChecksum == ((checksum<<8)&0xff00 | (checksum>>8)&0xff) {
 			endian = "big"
 		} else {
-			err = errors.New(fmt.Sprintf("invalid checksum, expected [%d] got [%d]", realChecksum, checksum))
+			err = decodeErr("CTRL", ErrBadChecksum, "expected [%d] got [%d]", realChecksum, checksum)
 			return
 		}
 	}
-	// typ := typeString(uint16(bytes[2])<<8 | uint16(bytes[3]))
-	// content := bytes[4:]
-	// switch typ {
-	// case "ERROR":
-	//     out, err = errMsgParse(content)
-	// case "PING", "PONG", "KEYPING", "KEYPONG":
-	//     out, err = pingParse(content, typ)
-	// default:
-	//     err = errors.New(fmt.Sprintf("could not parse, unknown type CTRL packet %s", typ))
-	// }
-	out.(map[string]interface{})["endian"] = endian
-	return
-}
\ No newline at end of file
+	typ := binary.BigEndian.Uint16(bytes[2:])
+	content := bytes[CtrlHeaderSize:]
+	msg := &CtrlMsg{Type: typ, TypeName: ctrlTypeString(typ), Endian: endian}
+	switch typ {
+	case CTRL_ERROR:
+		msg.Error, err = errMsgParse(content)
+	case CTRL_PING, CTRL_PONG, CTRL_KEYPING, CTRL_KEYPONG:
+		msg.Ping, err = pingParse(content, typ)
+	case CTRL_GETSNODE_QUERY, CTRL_GETSNODE_REPLY:
+		msg.GetSnode, err = getSnodeParse(content, typ)
+	case CTRL_RPATH_QUERY, CTRL_RPATH_REPLY:
+		msg.RPath, err = rpathParse(content, typ)
+	default:
+		err = decodeErr("CTRL", ErrUnknownType, "%s", msg.TypeName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func errMsgParse(content []byte) (*CtrlError, error) {
+	if len(content) < ctrlErrorMinSize {
+		return nil, decodeErr("CTRL ERROR", ErrRunt, "%d bytes", len(content))
+	}
+	cause := SwitchHeader{}
+	cause, err := cause.parse(content[4 : 4+SwitchHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	errorType := binary.BigEndian.Uint32(content)
+	return &CtrlError{
+		ErrorType:  errorType,
+		ErrorName:  ctrlErrorString(errorType),
+		Cause:      cause,
+		Nonce:      binary.BigEndian.Uint32(content[4+SwitchHeaderSize:]),
+		Additional: content[ctrlErrorMinSize:],
+	}, nil
+}
+
+func pingParse(content []byte, typ uint16) (*CtrlPing, error) {
+	isKey := typ == CTRL_KEYPING || typ == CTRL_KEYPONG
+	minSize := ctrlPingMinSize
+	if isKey {
+		minSize = ctrlKeyPingMinSize
+	}
+	if len(content) < minSize {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrRunt, "%d bytes", len(content))
+	}
+	ping := &CtrlPing{
+		Magic:   binary.BigEndian.Uint32(content),
+		Version: binary.BigEndian.Uint32(content[4:]),
+		Data:    content[minSize:],
+	}
+	if ping.Magic != ctrlMagic(typ) {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrBadMagic, "[%08x]", ping.Magic)
+	}
+	if len(ping.Data) > ctrlPingMaxDataSize {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrBadPayload, "%d bytes of data", len(ping.Data))
+	}
+	if isKey {
+		ping.Key = keyBytesToString(content[8:ctrlKeyPingMinSize])
+	}
+	return ping, nil
+}
+
+func getSnodeParse(content []byte, typ uint16) (*CtrlGetSnode, error) {
+	if len(content) < ctrlGetSnodeSize {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrRunt, "%d bytes", len(content))
+	}
+	gs := &CtrlGetSnode{
+		Magic:        binary.BigEndian.Uint32(content),
+		Version:      binary.BigEndian.Uint32(content[4:]),
+		SendKbps:     binary.BigEndian.Uint32(content[8:]),
+		SnodeVersion: binary.BigEndian.Uint32(content[12:]),
+		PathToSnode:  binary.BigEndian.Uint64(content[48:]),
+	}
+	if gs.Magic != ctrlMagic(typ) {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrBadMagic, "[%08x]", gs.Magic)
+	}
+	if !isAllZero(content[16:48]) {
+		gs.SnodeKey = keyBytesToString(content[16:48])
+	}
+	return gs, nil
+}
+
+func rpathParse(content []byte, typ uint16) (*CtrlRPath, error) {
+	if len(content) < ctrlRPathSize {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrRunt, "%d bytes", len(content))
+	}
+	rp := &CtrlRPath{
+		Magic:   binary.BigEndian.Uint32(content),
+		Version: binary.BigEndian.Uint32(content[4:]),
+		RPath:   binary.BigEndian.Uint64(content[8:]),
+	}
+	if rp.Magic != ctrlMagic(typ) {
+		return nil, decodeErr("CTRL "+ctrlTypeString(typ), ErrBadMagic, "[%08x]", rp.Magic)
+	}
+	return rp, nil
+}
+
+func ctrlMagic(typ uint16) uint32 {
+	switch typ {
+	case CTRL_PING:
+		return CTRL_PING_MAGIC
+	case CTRL_PONG:
+		return CTRL_PONG_MAGIC
+	case CTRL_KEYPING:
+		return CTRL_KEYPING_MAGIC
+	case CTRL_KEYPONG:
+		return CTRL_KEYPONG_MAGIC
+	case CTRL_GETSNODE_QUERY:
+		return CTRL_GETSNODE_QUERY_MAGIC
+	case CTRL_GETSNODE_REPLY:
+		return CTRL_GETSNODE_REPLY_MAGIC
+	case CTRL_RPATH_QUERY:
+		return CTRL_RPATH_QUERY_MAGIC
+	case CTRL_RPATH_REPLY:
+		return CTRL_RPATH_REPLY_MAGIC
+	}
+	return 0
+}
+
+// encode serializes the control frame and fills in its checksum.
+func (msg *CtrlMsg) encode() ([]byte, error) {
+	var content []byte
+	var err error
+	switch msg.Type {
+	case CTRL_ERROR:
+		content, err = msg.Error.encode()
+	case CTRL_PING, CTRL_PONG, CTRL_KEYPING, CTRL_KEYPONG:
+		content, err = msg.Ping.encode(msg.Type)
+	case CTRL_GETSNODE_QUERY, CTRL_GETSNODE_REPLY:
+		content, err = msg.GetSnode.encode(msg.Type)
+	case CTRL_RPATH_QUERY, CTRL_RPATH_REPLY:
+		content, err = msg.RPath.encode(msg.Type)
+	default:
+		err = errors.New(fmt.Sprintf("could not encode, unknown type CTRL packet %s", ctrlTypeString(msg.Type)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, CtrlHeaderSize, CtrlHeaderSize+len(content))
+	binary.BigEndian.PutUint16(out[2:], msg.Type)
+	out = append(out, content...)
+	binary.BigEndian.PutUint16(out, netChecksumRaw(out))
+	return out, nil
+}
+
+func (ce *CtrlError) encode() ([]byte, error) {
+	if ce == nil {
+		return nil, errors.New("CTRL ERROR body missing")
+	}
+	out := make([]byte, ctrlErrorMinSize, ctrlErrorMinSize+len(ce.Additional))
+	binary.BigEndian.PutUint32(out, ce.ErrorType)
+	copy(out[4:], ce.Cause.serialize())
+	binary.BigEndian.PutUint32(out[4+SwitchHeaderSize:], ce.Nonce)
+	return append(out, ce.Additional...), nil
+}
+
+func (cp *CtrlPing) encode(typ uint16) ([]byte, error) {
+	if cp == nil {
+		return nil, errors.New(fmt.Sprintf("CTRL %s body missing", ctrlTypeString(typ)))
+	}
+	if len(cp.Data) > ctrlPingMaxDataSize {
+		return nil, errors.New(fmt.Sprintf("CTRL %s data too long", ctrlTypeString(typ)))
+	}
+	size := ctrlPingMinSize
+	if typ == CTRL_KEYPING || typ == CTRL_KEYPONG {
+		size = ctrlKeyPingMinSize
+	}
+	out := make([]byte, size, size+len(cp.Data))
+	binary.BigEndian.PutUint32(out, ctrlMagic(typ))
+	binary.BigEndian.PutUint32(out[4:], cp.Version)
+	if size == ctrlKeyPingMinSize {
+		keyBytes := stringToKeyBytes(cp.Key)
+		if len(keyBytes) != 32 {
+			return nil, errors.New(fmt.Sprintf("CTRL %s needs a valid key", ctrlTypeString(typ)))
+		}
+		copy(out[8:], keyBytes)
+	}
+	return append(out, cp.Data...), nil
+}
+
+func (gs *CtrlGetSnode) encode(typ uint16) ([]byte, error) {
+	if gs == nil {
+		return nil, errors.New(fmt.Sprintf("CTRL %s body missing", ctrlTypeString(typ)))
+	}
+	out := make([]byte, ctrlGetSnodeSize)
+	binary.BigEndian.PutUint32(out, ctrlMagic(typ))
+	binary.BigEndian.PutUint32(out[4:], gs.Version)
+	binary.BigEndian.PutUint32(out[8:], gs.SendKbps)
+	binary.BigEndian.PutUint32(out[12:], gs.SnodeVersion)
+	if gs.SnodeKey != "" {
+		keyBytes := stringToKeyBytes(gs.SnodeKey)
+		if len(keyBytes) != 32 {
+			return nil, errors.New("CTRL GETSNODE has an invalid snode key")
+		}
+		copy(out[16:], keyBytes)
+	}
+	binary.BigEndian.PutUint64(out[48:], gs.PathToSnode)
+	return out, nil
+}
+
+func (rp *CtrlRPath) encode(typ uint16) ([]byte, error) {
+	if rp == nil {
+		return nil, errors.New(fmt.Sprintf("CTRL %s body missing", ctrlTypeString(typ)))
+	}
+	out := make([]byte, ctrlRPathSize)
+	binary.BigEndian.PutUint32(out, ctrlMagic(typ))
+	binary.BigEndian.PutUint32(out[4:], rp.Version)
+	binary.BigEndian.PutUint64(out[8:], rp.RPath)
+	return out, nil
+}
@@ -13,15 +13,19 @@ const (
 type DataHeader struct {
 	ContentType uint16
 	Version     int
+	// Flags is the low nibble of the first byte, Unused the second byte.
+	// Neither means anything yet, they are kept so frames re-encode as is.
+	Flags  int
+	Unused byte
 }
 
 func (dh * DataHeader) parse(bytes []byte) (DataHeader, error) {
 	if len(bytes) < 4 {
-		return DataHeader{}, fmt.Errorf("DataHeader too short")
+		return DataHeader{}, decodeErr("DataHeader", ErrRunt, "%d bytes", len(bytes))
 	}
 
 	versionAndFlags := bytes[0]
-	//unused := bytes[1]
+	unused := bytes[1]
 	contentType := binary.BigEndian.Uint16(bytes[2:])
 
 	version := versionAndFlags >> 4
@@ -29,6 +33,8 @@ func (dh * DataHeader) parse(bytes []byte) (DataHeader, error) {
 	return DataHeader{
 		ContentType: contentType,
 		Version:     int(version),
+		Flags:       int(versionAndFlags & 0x0f),
+		Unused:      unused,
 	}, nil
 }
 
@@ -39,9 +45,9 @@ func (dh *DataHeader) encode() ([]byte, error) {
 
     buf := new(bytes.Buffer)
 
-    versionAndFlags := byte(dh.Version << 4)
+    versionAndFlags := byte(dh.Version<<4) | byte(dh.Flags&0x0f)
     binary.Write(buf, binary.BigEndian, versionAndFlags)
-    binary.Write(buf, binary.BigEndian, uint8(0))
+    binary.Write(buf, binary.BigEndian, dh.Unused)
     binary.Write(buf, binary.BigEndian, dh.ContentType)
 
     return buf.Bytes(), nil
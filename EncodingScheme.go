@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/zeebo/bencode"
+)
+
+// EncodingForm is one way a node encodes a director in a label: prefixLen
+// bits of prefix, followed by bitCount bits of director number, read from
+// the least significant end.
+type EncodingForm struct {
+	BitCount  int
+	PrefixLen int
+	Prefix    uint64
+}
+
+// EncodingScheme is the list of forms a node's switch understands.
+type EncodingScheme []EncodingForm
+
+// SchemeV358 is the scheme cjdns uses by default, with 3, 5 and 8 bit
+// director forms.
+var SchemeV358 = EncodingScheme{
+	{BitCount: 3, PrefixLen: 1, Prefix: 1},
+	{BitCount: 5, PrefixLen: 2, Prefix: 2},
+	{BitCount: 8, PrefixLen: 2, Prefix: 0},
+}
+
+// Hop is one director of a label, with the form it was encoded in.
+type Hop struct {
+	Director uint64
+	Form     int
+	Bits     int
+}
+
+// UnmarshalBencode decodes the admin API form of an EncodingForm, a dict
+// of bitCount, prefixLen and a hex prefix.
+func (ef *EncodingForm) UnmarshalBencode(b []byte) error {
+	var form struct {
+		BitCount  int64  `bencode:"bitCount"`
+		PrefixLen int64  `bencode:"prefixLen"`
+		Prefix    string `bencode:"prefix"`
+	}
+	if err := bencode.DecodeBytes(b, &form); err != nil {
+		return err
+	}
+	prefix, err := hex.DecodeString(form.Prefix)
+	if err != nil {
+		return fmt.Errorf("bad encoding form prefix %q: %v", form.Prefix, err)
+	}
+	ef.BitCount = int(form.BitCount)
+	ef.PrefixLen = int(form.PrefixLen)
+	ef.Prefix = 0
+	for _, b := range prefix {
+		ef.Prefix = ef.Prefix<<8 | uint64(b)
+	}
+	return nil
+}
+
+func (ef EncodingForm) MarshalBencode() ([]byte, error) {
+	return bencode.EncodeBytes(map[string]interface{}{
+		"bitCount":  int64(ef.BitCount),
+		"prefixLen": int64(ef.PrefixLen),
+		"prefix":    fmt.Sprintf("%02x", ef.Prefix),
+	})
+}
+
+func (ef EncodingForm) width() int {
+	return ef.PrefixLen + ef.BitCount
+}
+
+// Validate checks the rules cjdns enforces on a scheme.
+func (es EncodingScheme) Validate() error {
+	if len(es) == 0 {
+		return errors.New("encoding scheme has no forms")
+	}
+	if len(es) > 31 {
+		return errors.New("encoding scheme has too many forms")
+	}
+	for i, form := range es {
+		if form.BitCount < 1 || form.BitCount > 31 || form.PrefixLen > 31 {
+			return fmt.Errorf("encoding form %d out of range", i)
+		}
+		if len(es) > 1 && form.PrefixLen == 0 {
+			return fmt.Errorf("encoding form %d needs a prefix", i)
+		}
+		if form.Prefix>>uint(form.PrefixLen) != 0 {
+			return fmt.Errorf("encoding form %d prefix longer than prefixLen", i)
+		}
+		if i > 0 && form.BitCount <= es[i-1].BitCount {
+			return errors.New("encoding forms must grow in bitCount")
+		}
+	}
+	return nil
+}
+
+// DecodeEncodingScheme reads the compact form cjdns puts in DHT messages:
+// per form 5 bits prefixLen, 5 bits bitCount and prefixLen bits prefix,
+// packed from the least significant bit of the first byte.
+func DecodeEncodingScheme(b []byte) (EncodingScheme, error) {
+	var es EncodingScheme
+	total := len(b) * 8
+	pos := 0
+	read := func(n int) uint64 {
+		var v uint64
+		for i := 0; i < n; i++ {
+			if b[(pos+i)/8]&(1<<uint((pos+i)%8)) != 0 {
+				v |= 1 << uint(i)
+			}
+		}
+		pos += n
+		return v
+	}
+	for total-pos >= 10 {
+		prefixLen := int(read(5))
+		bitCount := int(read(5))
+		if prefixLen > total-pos {
+			return nil, errors.New("encoding scheme truncated")
+		}
+		es = append(es, EncodingForm{BitCount: bitCount, PrefixLen: prefixLen, Prefix: read(prefixLen)})
+	}
+	if err := es.Validate(); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// Serialize writes the compact form read by DecodeEncodingScheme.
+func (es EncodingScheme) Serialize() []byte {
+	var out []byte
+	pos := 0
+	write := func(v uint64, n int) {
+		for i := 0; i < n; i++ {
+			if pos/8 >= len(out) {
+				out = append(out, 0)
+			}
+			if v&(1<<uint(i)) != 0 {
+				out[pos/8] |= 1 << uint(pos%8)
+			}
+			pos++
+		}
+	}
+	for _, form := range es {
+		write(uint64(form.PrefixLen), 5)
+		write(uint64(form.BitCount), 5)
+		write(form.Prefix, form.PrefixLen)
+	}
+	return out
+}
+
+// formFor returns the index of the form whose prefix l starts with.
+func (es EncodingScheme) formFor(l Label) (int, error) {
+	if len(es) == 1 {
+		return 0, nil
+	}
+	for i, form := range es {
+		mask := uint64(1)<<uint(form.PrefixLen) - 1
+		if uint64(l)&mask == form.Prefix {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("label %s matches no encoding form", l)
+}
+
+// Director splits the first hop off l, returning it and the rest of the
+// label.
+func (es EncodingScheme) Director(l Label) (Hop, Label, error) {
+	if !l.Valid() {
+		return Hop{}, 0, errors.New("label 0 has no directors")
+	}
+	i, err := es.formFor(l)
+	if err != nil {
+		return Hop{}, 0, err
+	}
+	form := es[i]
+	if l.bitsUsed() < form.width() {
+		return Hop{}, 0, fmt.Errorf("label %s too short for encoding form %d", l, i)
+	}
+	director := (uint64(l) >> uint(form.PrefixLen)) & (uint64(1)<<uint(form.BitCount) - 1)
+	return Hop{Director: director, Form: i, Bits: form.width()}, l >> uint(form.width()), nil
+}
+
+// Directors splits l into its per-hop directors, assuming every hop uses
+// es. Self route directors are kept, they are part of the path.
+func (es EncodingScheme) Directors(l Label) ([]Hop, error) {
+	var hops []Hop
+	for l > 1 {
+		hop, rest, err := es.Director(l)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop)
+		l = rest
+	}
+	if l != 1 {
+		return nil, errors.New("label 0 has no directors")
+	}
+	return hops, nil
+}
+
+// IsOneHop reports whether l is a single director in es.
+func (es EncodingScheme) IsOneHop(l Label) bool {
+	_, rest, err := es.Director(l)
+	return err == nil && rest == 1
+}
+
+// EncodeDirector returns the bits and width of director in the smallest
+// form that holds it.
+func (es EncodingScheme) EncodeDirector(director uint64) (uint64, int, error) {
+	for _, form := range es {
+		if bits.Len64(director) <= form.BitCount {
+			return director<<uint(form.PrefixLen) | form.Prefix, form.width(), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("director %d too large for encoding scheme", director)
+}
+
+// Encode builds a label from per-hop directors, all encoded with es.
+func (es EncodingScheme) Encode(directors []uint64) (Label, error) {
+	var out uint64
+	pos := 0
+	for _, director := range directors {
+		v, width, err := es.EncodeDirector(director)
+		if err != nil {
+			return 0, err
+		}
+		if pos+width > 63 {
+			return 0, ErrLabelTooLong
+		}
+		out |= v << uint(pos)
+		pos += width
+	}
+	return Label(out | 1<<uint(pos)), nil
+}
+
+// ConvertLabel re-encodes every director of l from one scheme to another,
+// each in the smallest form that fits.
+func ConvertLabel(l Label, from EncodingScheme, to EncodingScheme) (Label, error) {
+	hops, err := from.Directors(l)
+	if err != nil {
+		return 0, err
+	}
+	directors := make([]uint64, len(hops))
+	for i, hop := range hops {
+		directors[i] = hop.Director
+	}
+	return to.Encode(directors)
+}
+
+func (es EncodingScheme) String() string {
+	forms := make([]string, len(es))
+	for i, form := range es {
+		forms[i] = fmt.Sprintf("%d:%0*b+%d", i, form.PrefixLen, form.Prefix, form.BitCount)
+	}
+	return strings.Join(forms, " ")
+}
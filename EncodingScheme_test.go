@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+// v358 packs as prefixLen, bitCount, prefix per form, least significant
+// bit first: 1,3,1 then 2,5,2 then 2,8,0 in 35 bits.
+const v358Serialized = "6114458100"
+
+func TestEncodingSchemeSerialize(t *testing.T) {
+	if got := hex.EncodeToString(SchemeV358.Serialize()); got != v358Serialized {
+		t.Fatalf("SchemeV358.Serialize() = %s, want %s", got, v358Serialized)
+	}
+	raw, _ := hex.DecodeString(v358Serialized)
+	es, err := DecodeEncodingScheme(raw)
+	if err != nil || !reflect.DeepEqual(es, SchemeV358) {
+		t.Fatalf("DecodeEncodingScheme(%s) = %v, %v", v358Serialized, es, err)
+	}
+	single := EncodingScheme{{BitCount: 4}}
+	es, err = DecodeEncodingScheme(single.Serialize())
+	if err != nil || !reflect.DeepEqual(es, single) {
+		t.Fatalf("single form round trip = %v, %v", es, err)
+	}
+}
+
+func TestDecodeEncodingSchemeInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":          nil,
+		"under one form": {0x61},
+		"prefix cut off": {0xff, 0x03},
+		"shrinking forms": EncodingScheme{
+			{BitCount: 5, PrefixLen: 1, Prefix: 1},
+			{BitCount: 3, PrefixLen: 1, Prefix: 0},
+		}.Serialize(),
+		"missing prefix": EncodingScheme{
+			{BitCount: 3, PrefixLen: 0},
+			{BitCount: 5, PrefixLen: 1, Prefix: 0},
+		}.Serialize(),
+	}
+	for name, raw := range tests {
+		if es, err := DecodeEncodingScheme(raw); err == nil {
+			t.Errorf("%s: DecodeEncodingScheme(%x) = %v, want error", name, raw, es)
+		}
+	}
+}
+
+func TestEncodingFormBencode(t *testing.T) {
+	admin := []map[string]interface{}{
+		{"bitCount": 3, "prefix": "01", "prefixLen": 1},
+		{"bitCount": 5, "prefix": "02", "prefixLen": 2},
+		{"bitCount": 8, "prefix": "00", "prefixLen": 2},
+	}
+	raw, err := bencode.EncodeBytes(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var es EncodingScheme
+	if err := bencode.DecodeBytes(raw, &es); err != nil || !reflect.DeepEqual(es, SchemeV358) {
+		t.Fatalf("decoded admin scheme = %v, %v", es, err)
+	}
+	again, err := bencode.EncodeBytes(es)
+	if err != nil || !bytes.Equal(again, raw) {
+		t.Fatalf("re-encoded admin scheme = %s, %v, want %s", again, err, raw)
+	}
+}
+
+func TestEncodingSchemeDirectors(t *testing.T) {
+	tests := []struct {
+		l    Label
+		hops []Hop
+	}{
+		{0x13, []Hop{{Director: 1, Form: 0, Bits: 4}}},
+		{0x135, []Hop{{Director: 2, Form: 0, Bits: 4}, {Director: 1, Form: 0, Bits: 4}}},
+		{0xa2, []Hop{{Director: 8, Form: 1, Bits: 7}}},
+		{0x4a0, []Hop{{Director: 40, Form: 2, Bits: 10}}},
+		{0x4a0<<4 | 0x3, []Hop{{Director: 1, Form: 0, Bits: 4}, {Director: 40, Form: 2, Bits: 10}}},
+		{0x01, nil},
+	}
+	for _, tt := range tests {
+		hops, err := SchemeV358.Directors(tt.l)
+		if err != nil || !reflect.DeepEqual(hops, tt.hops) {
+			t.Errorf("Directors(%s) = %v, %v, want %v", tt.l, hops, err, tt.hops)
+			continue
+		}
+		directors := make([]uint64, len(hops))
+		for i, hop := range hops {
+			directors[i] = hop.Director
+		}
+		if l, err := SchemeV358.Encode(directors); err != nil || l != tt.l {
+			t.Errorf("Encode(%v) = %s, %v, want %s", directors, l, err, tt.l)
+		}
+	}
+	for _, l := range []Label{0, 0x03, 0x0c} {
+		if hops, err := SchemeV358.Directors(l); err == nil {
+			t.Errorf("Directors(%s) = %v, want error", l, hops)
+		}
+	}
+	if _, err := SchemeV358.Encode([]uint64{256}); err == nil {
+		t.Error("Encode(256) fits no v358 form, want error")
+	}
+}
+
+func TestConvertLabel(t *testing.T) {
+	fourBit := EncodingScheme{{BitCount: 4}}
+	tests := []struct {
+		l        Label
+		from, to EncodingScheme
+		want     Label
+	}{
+		{0x135, SchemeV358, fourBit, 0x112},
+		{0x112, fourBit, SchemeV358, 0x135},
+		{0x1f, fourBit, SchemeV358, 0xbe},
+		{0xbe, SchemeV358, fourBit, 0x1f},
+	}
+	for _, tt := range tests {
+		got, err := ConvertLabel(tt.l, tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("ConvertLabel(%s, %v, %v) = %s, %v, want %s", tt.l, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+}
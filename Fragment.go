@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// RESERVED content is coinType followed by a bencoded message. A message
+// that does not fit one datagram is sent as fragments instead, marked by a
+// header that can never start bencode:
+//
+//	coinType(4) | 0xff 'F' | msgId(4) | index(2) | count(2) | bytes
+const (
+	// Default cjdns tun MTU less the IPv6 and UDP headers
+	cjdnsMTU           = 1304 - 40 - 8
+	maxContentSize     = cjdnsMTU - RouteHeaderSize - DataHeaderSize
+	fragmentHeaderSize = 10
+	maxFragments       = 256
+	fragmentTimeout    = 10 * time.Second
+	maxPartialPerKey   = 4
+	maxReassemblyBytes = 4 << 20
+	// partSlotSize is what each expected fragment costs before it arrives,
+	// the slice header that will hold it.
+	partSlotSize = 24
+)
+
+var fragmentMagic = []byte{0xff, 'F'}
+
+// Fragment is the decoded Content of one fragment datagram.
+type Fragment struct {
+	MsgId uint32
+	Index int
+	Count int
+	Bytes []byte
+}
+
+func isFragment(content []byte) bool {
+	return len(content) >= 2 && content[0] == fragmentMagic[0] && content[1] == fragmentMagic[1]
+}
+
+func parseFragment(content []byte) (*Fragment, error) {
+	if len(content) < fragmentHeaderSize {
+		return nil, decodeErr("fragment", ErrRunt, "%d bytes", len(content))
+	}
+	frag := &Fragment{
+		MsgId: binary.BigEndian.Uint32(content[2:]),
+		Index: int(binary.BigEndian.Uint16(content[6:])),
+		Count: int(binary.BigEndian.Uint16(content[8:])),
+		Bytes: content[fragmentHeaderSize:],
+	}
+	if frag.Count == 0 || frag.Count > maxFragments || frag.Index >= frag.Count {
+		return nil, decodeErr("fragment", ErrBadPayload, "fragment %d of %d", frag.Index, frag.Count)
+	}
+	return frag, nil
+}
+
+// fragmentContent splits the bencoded part of a RESERVED payload into the
+// contents of as many datagrams as needed, each starting with coinType.
+// Content that fits one datagram is returned unchanged.
+func fragmentContent(encoded []byte) ([][]byte, error) {
+	if len(coinType)+len(encoded) <= maxContentSize {
+		return [][]byte{append(append([]byte(nil), coinType...), encoded...)}, nil
+	}
+	chunk := maxContentSize - len(coinType) - fragmentHeaderSize
+	count := (len(encoded) + chunk - 1) / chunk
+	if count > maxFragments {
+		return nil, fmt.Errorf("message of %d bytes needs more than %d fragments", len(encoded), maxFragments)
+	}
+	msgId := rand.Uint32()
+	out := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		content := make([]byte, 0, len(coinType)+fragmentHeaderSize+end-i*chunk)
+		content = append(content, coinType...)
+		content = append(content, fragmentMagic...)
+		header := make([]byte, fragmentHeaderSize-len(fragmentMagic))
+		binary.BigEndian.PutUint32(header[0:], msgId)
+		binary.BigEndian.PutUint16(header[4:], uint16(i))
+		binary.BigEndian.PutUint16(header[6:], uint16(count))
+		content = append(content, header...)
+		content = append(content, encoded[i*chunk:end]...)
+		out = append(out, content)
+	}
+	return out, nil
+}
+
+type fragmentKey struct {
+	publicKey string
+	msgId     uint32
+}
+
+type partialMessage struct {
+	key   fragmentKey
+	parts [][]byte
+	have  int
+	size  int
+	first time.Time
+	elem  *list.Element
+}
+
+// Reassembler collects fragments per source public key and message id,
+// dropping messages whose fragments do not all arrive within Timeout.
+// A key may have MaxPerKey messages in progress and all of them together
+// may hold MaxBytes, past that the oldest message is dropped.
+type Reassembler struct {
+	Timeout   time.Duration
+	MaxPerKey int
+	MaxBytes  int
+
+	mu      sync.Mutex
+	partial map[fragmentKey]*partialMessage
+	order   *list.List // of *partialMessage, oldest first
+	perKey  map[string]int
+	size    int
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		Timeout:   fragmentTimeout,
+		MaxPerKey: maxPartialPerKey,
+		MaxBytes:  maxReassemblyBytes,
+		partial:   make(map[fragmentKey]*partialMessage),
+		order:     list.New(),
+		perKey:    make(map[string]int),
+	}
+}
+
+// Add passes through messages that are not fragments. For a fragment it
+// returns the reassembled message once the last one arrives, and false
+// until then.
+func (r *Reassembler) Add(message Message) (Message, bool) {
+	frag, ok := message.Content.(*Fragment)
+	if !ok {
+		return message, true
+	}
+	now := time.Now()
+	key := fragmentKey{publicKey: message.RouteHeader.PublicKey, msgId: frag.MsgId}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+	p, ok := r.partial[key]
+	if !ok {
+		if r.perKey[key.publicKey] >= r.MaxPerKey {
+			fmt.Println("Dropping fragment of message", frag.MsgId, "from", key.publicKey, "with too many messages in progress")
+			return Message{}, false
+		}
+		p = &partialMessage{key: key, parts: make([][]byte, frag.Count), size: frag.Count * partSlotSize, first: now}
+		p.elem = r.order.PushBack(p)
+		r.partial[key] = p
+		r.perKey[key.publicKey]++
+		r.size += p.size
+	}
+	if len(p.parts) != frag.Count {
+		r.drop(p)
+		fmt.Println("Dropping message", frag.MsgId, "with inconsistent fragment count")
+		return Message{}, false
+	}
+	if p.parts[frag.Index] == nil {
+		p.parts[frag.Index] = append([]byte(nil), frag.Bytes...)
+		p.have++
+		p.size += len(frag.Bytes)
+		r.size += len(frag.Bytes)
+	}
+	if p.have < frag.Count {
+		for r.size > r.MaxBytes {
+			oldest := r.order.Front().Value.(*partialMessage)
+			fmt.Println("Dropping incomplete message", oldest.key.msgId, "from", oldest.key.publicKey, "to stay within", r.MaxBytes, "bytes")
+			r.drop(oldest)
+			if oldest == p {
+				break
+			}
+		}
+		return Message{}, false
+	}
+	r.drop(p)
+
+	var encoded []byte
+	for _, part := range p.parts {
+		encoded = append(encoded, part...)
+	}
+	message.ContentBytes = append(append([]byte(nil), coinType...), encoded...)
+	message.RawBytes = nil
+	message.Content = nil
+	message.ContentBenc = nil
+	if err := bencode.DecodeBytes(encoded, &message.ContentBenc); err != nil {
+		fmt.Println("Error decoding reassembled message:", err)
+	}
+	return message, true
+}
+
+// expire drops the messages started more than r.Timeout ago, r.mu is held.
+func (r *Reassembler) expire(now time.Time) {
+	for e := r.order.Front(); e != nil; e = r.order.Front() {
+		p := e.Value.(*partialMessage)
+		if now.Sub(p.first) <= r.Timeout {
+			return
+		}
+		fmt.Println("Dropping incomplete message", p.key.msgId, "from", p.key.publicKey)
+		r.drop(p)
+	}
+}
+
+// drop forgets p, r.mu is held.
+func (r *Reassembler) drop(p *partialMessage) {
+	r.order.Remove(p.elem)
+	delete(r.partial, p.key)
+	r.size -= p.size
+	if r.perKey[p.key.publicKey]--; r.perKey[p.key.publicKey] == 0 {
+		delete(r.perKey, p.key.publicKey)
+	}
+}
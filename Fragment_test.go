@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+func fragmentMessages(t *testing.T, publicKey string, parts [][]byte) []Message {
+	messages := make([]Message, len(parts))
+	for i, part := range parts {
+		frag, err := parseFragment(part[len(coinType):])
+		if err != nil {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+		messages[i] = Message{RouteHeader: RouteHeader{PublicKey: publicKey}, ContentBytes: part, Content: frag}
+	}
+	return messages
+}
+
+func TestFragmentContent(t *testing.T) {
+	small := []byte("d1:q4:pinge")
+	parts, err := fragmentContent(small)
+	if err != nil || len(parts) != 1 || !bytes.Equal(parts[0], append(append([]byte(nil), coinType...), small...)) {
+		t.Fatalf("fragmentContent(small) = %x, %v", parts, err)
+	}
+
+	chunk := maxContentSize - len(coinType) - fragmentHeaderSize
+	tests := []struct {
+		size  int
+		count int
+	}{
+		{maxContentSize - len(coinType) + 1, 2},
+		{chunk * 2, 2},
+		{chunk*2 + 1, 3},
+		{chunk * maxFragments, maxFragments},
+	}
+	for _, tt := range tests {
+		encoded := bytes.Repeat([]byte{'x'}, tt.size)
+		parts, err := fragmentContent(encoded)
+		if err != nil || len(parts) != tt.count {
+			t.Errorf("fragmentContent(%d bytes) = %d parts, %v, want %d", tt.size, len(parts), err, tt.count)
+			continue
+		}
+		var joined []byte
+		for i, part := range parts {
+			if len(part) > maxContentSize || !bytes.Equal(part[:len(coinType)], coinType) {
+				t.Fatalf("part %d of %d bytes is malformed", i, len(part))
+			}
+			frag, err := parseFragment(part[len(coinType):])
+			if err != nil || frag.Index != i || frag.Count != tt.count {
+				t.Fatalf("part %d = %+v, %v", i, frag, err)
+			}
+			joined = append(joined, frag.Bytes...)
+		}
+		if !bytes.Equal(joined, encoded) {
+			t.Errorf("fragments of %d bytes do not join back", tt.size)
+		}
+	}
+	if _, err := fragmentContent(make([]byte, chunk*maxFragments+1)); err == nil {
+		t.Error("fragmentContent accepted more than maxFragments")
+	}
+}
+
+func TestParseFragmentInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"runt":           {0xff, 'F', 0, 0, 0, 1, 0, 0},
+		"zero count":     {0xff, 'F', 0, 0, 0, 1, 0, 0, 0, 0},
+		"index too high": {0xff, 'F', 0, 0, 0, 1, 0, 2, 0, 2},
+		"count too high": {0xff, 'F', 0, 0, 0, 1, 0, 0, 0x01, 0x01},
+	}
+	for name, content := range tests {
+		if frag, err := parseFragment(content); err == nil {
+			t.Errorf("%s: parseFragment = %+v, want error", name, frag)
+		}
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	msg := map[string]interface{}{"q": "invoice_req", "txid": "1", "data": strings.Repeat("y", 3*maxContentSize)}
+	encoded, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := fragmentContent(encoded)
+	if err != nil || len(parts) < 3 {
+		t.Fatalf("fragmentContent = %d parts, %v", len(parts), err)
+	}
+	messages := fragmentMessages(t, "a.k", parts)
+
+	r := NewReassembler()
+	plain := Message{ContentBenc: msg}
+	if got, ok := r.Add(plain); !ok || !reflect.DeepEqual(got, plain) {
+		t.Fatalf("Add(non fragment) = %v, %v", got, ok)
+	}
+	// Last first, then a duplicate, then the rest.
+	order := []int{len(messages) - 1, len(messages) - 1}
+	for i := 0; i < len(messages)-1; i++ {
+		order = append(order, i)
+	}
+	for n, i := range order {
+		got, ok := r.Add(messages[i])
+		if n < len(order)-1 {
+			if ok {
+				t.Fatalf("Add completed after %d of %d fragments", n+1, len(order))
+			}
+			continue
+		}
+		if !ok {
+			t.Fatal("Add did not complete after every fragment")
+		}
+		if !bytes.Equal(got.ContentBytes, append(append([]byte(nil), coinType...), encoded...)) {
+			t.Fatal("reassembled ContentBytes differ")
+		}
+		benc, _ := got.ContentBenc.(map[string]interface{})
+		if benc["data"] != msg["data"] || got.Content != nil {
+			t.Fatalf("reassembled message = %v, %v", benc["q"], got.Content)
+		}
+	}
+	if len(r.partial) != 0 {
+		t.Fatalf("%d partial messages left", len(r.partial))
+	}
+}
+
+func TestReassemblerKeysAndTimeout(t *testing.T) {
+	parts, err := fragmentContent(bytes.Repeat([]byte{'z'}, 2*maxContentSize))
+	if err != nil || len(parts) != 3 {
+		t.Fatalf("fragmentContent = %d parts, %v", len(parts), err)
+	}
+	fromA := fragmentMessages(t, "a.k", parts)
+	fromB := fragmentMessages(t, "b.k", parts)
+
+	r := NewReassembler()
+	r.Add(fromA[0])
+	r.Add(fromA[1])
+	// The same msgId from another key is another message.
+	if _, ok := r.Add(fromB[2]); ok {
+		t.Fatal("fragments from two keys were joined")
+	}
+	r.Timeout = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, ok := r.Add(fromA[2]); ok {
+		t.Fatal("expired fragments were joined")
+	}
+	if len(r.partial) != 1 {
+		t.Fatalf("%d partial messages left, want only the new one", len(r.partial))
+	}
+}
+
+// floodFragment is the first of count fragments of message msgId.
+func floodFragment(publicKey string, msgId uint32, count int, size int) Message {
+	frag := &Fragment{MsgId: msgId, Index: 0, Count: count, Bytes: make([]byte, size)}
+	return Message{RouteHeader: RouteHeader{PublicKey: publicKey}, Content: frag}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	r := NewReassembler()
+	for id := uint32(0); id < 100; id++ {
+		r.Add(floodFragment("a.k", id, maxFragments, 1000))
+	}
+	if len(r.partial) != maxPartialPerKey || r.perKey["a.k"] != maxPartialPerKey {
+		t.Fatalf("one key holds %d partial messages, want %d", len(r.partial), maxPartialPerKey)
+	}
+	if _, ok := r.partial[fragmentKey{"a.k", 0}]; !ok {
+		t.Fatal("the messages in progress were replaced by newer ones")
+	}
+	r.Add(floodFragment("b.k", 0, maxFragments, 1000))
+	if r.perKey["b.k"] != 1 {
+		t.Fatal("a flooding key blocked another one")
+	}
+
+	r = NewReassembler()
+	r.MaxBytes = 10 * (maxFragments*partSlotSize + 1000)
+	for n := 0; n < 1000; n++ {
+		r.Add(floodFragment(strings.Repeat("k", n%50+1), uint32(n), maxFragments, 1000))
+		if r.size > r.MaxBytes {
+			t.Fatalf("after %d fragments %d bytes are buffered, limit %d", n+1, r.size, r.MaxBytes)
+		}
+	}
+	if len(r.partial) != 10 || r.order.Len() != 10 {
+		t.Fatalf("%d partial messages left, want 10", len(r.partial))
+	}
+	if _, ok := r.partial[fragmentKey{strings.Repeat("k", 999%50+1), 999}]; !ok {
+		t.Fatal("the newest message was dropped instead of the oldest")
+	}
+
+	// A message that completes is delivered and frees its bytes.
+	parts, err := fragmentContent(bytes.Repeat([]byte{'z'}, 2*maxContentSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var done bool
+	for _, message := range fragmentMessages(t, "c.k", parts) {
+		_, done = r.Add(message)
+	}
+	if !done || r.size > r.MaxBytes {
+		t.Fatalf("complete = %v with %d bytes buffered", done, r.size)
+	}
+}
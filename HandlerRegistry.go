@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const defaultHandlerStateFile = "cjdns_bridge_handlers.json"
+
+// HandlerEntry is one UpperDistributor registration, as listed by
+// UpperDistributor_listHandlers.
+type HandlerEntry struct {
+	ContentType int64 `bencode:"type" json:"contentType"`
+	UdpPort     int64 `bencode:"udpPort" json:"udpPort"`
+}
+
+// HandlerRegistry records the UpperDistributor handlers this process has
+// registered so they can be replayed after cjdroute restarts. Entries are
+// keyed by content type and udpPort, as a Router listens for several
+// content types on one port. The registrations are also written to path,
+// so the next run can remove the ones a crashed process leaked.
+type HandlerRegistry struct {
+	mu       sync.Mutex
+	handlers map[HandlerEntry]bool
+	path     string
+	// stale holds a previous run's registrations that could not be
+	// checked against cjdroute yet, they are saved until they are.
+	stale []HandlerEntry
+}
+
+var handlers = HandlerRegistry{handlers: make(map[HandlerEntry]bool)}
+
+func (hr *HandlerRegistry) add(contentType int64, udpPort int64) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.handlers[HandlerEntry{ContentType: contentType, UdpPort: udpPort}] = true
+	hr.save()
+}
+
+func (hr *HandlerRegistry) remove(contentType int64, udpPort int64) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	delete(hr.handlers, HandlerEntry{ContentType: contentType, UdpPort: udpPort})
+	hr.save()
+}
+
+// save writes the registrations to hr.path, hr.mu is held.
+func (hr *HandlerRegistry) save() {
+	if hr.path == "" {
+		return
+	}
+	entries := make([]HandlerEntry, 0, len(hr.handlers)+len(hr.stale))
+	for entry := range hr.handlers {
+		entries = append(entries, entry)
+	}
+	for _, entry := range hr.stale {
+		if !hr.handlers[entry] {
+			entries = append(entries, entry)
+		}
+	}
+	bytes, err := json.Marshal(entries)
+	if err == nil {
+		err = ioutil.WriteFile(hr.path, bytes, 0644)
+	}
+	if err != nil {
+		fmt.Println("Error saving handler registry:", err)
+	}
+}
+
+// snapshot returns a copy of the registrations.
+func (hr *HandlerRegistry) snapshot() map[HandlerEntry]bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	out := make(map[HandlerEntry]bool, len(hr.handlers))
+	for entry := range hr.handlers {
+		out[entry] = true
+	}
+	return out
+}
+
+// replay registers again the recorded handlers cjdroute no longer lists,
+// which after a restart is all of them. The connection also drops without
+// a restart, so those still listed are left alone. Stale handlers left
+// from before are removed too, if reconcile could not reach cjdroute at
+// startup.
+func (hr *HandlerRegistry) replay() {
+	listed, err := listHandlers()
+	if err != nil {
+		fmt.Println("Error listing handlers, registering all again:", err)
+	}
+	live := make(map[HandlerEntry]bool, len(listed))
+	for _, entry := range listed {
+		live[entry] = true
+	}
+	for entry := range hr.snapshot() {
+		if live[entry] {
+			continue
+		}
+		err := registerHandler(entry.ContentType, entry.UdpPort)
+		if err != nil {
+			fmt.Println("Error re-registering handler", entry, ":", err)
+		}
+	}
+	if err := hr.removeStale(); err != nil {
+		fmt.Println("Error removing stale handlers:", err)
+	}
+}
+
+// reconcile starts persisting to path and unregisters every handler that a
+// previous run recorded there and that cjdroute still lists. If cjdroute
+// cannot be asked, those handlers stay in the file for the next attempt.
+func (hr *HandlerRegistry) reconcile(path string) error {
+	var stale []HandlerEntry
+	bytes, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(bytes, &stale)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error reading handler registry:", err)
+	}
+
+	hr.mu.Lock()
+	hr.path = path
+	hr.stale = append(hr.stale, stale...)
+	hr.save()
+	hr.mu.Unlock()
+	return hr.removeStale()
+}
+
+// removeStale unregisters the stale handlers cjdroute still lists and
+// forgets the rest.
+func (hr *HandlerRegistry) removeStale() error {
+	hr.mu.Lock()
+	stale := hr.stale
+	hr.mu.Unlock()
+	if len(stale) == 0 {
+		return nil
+	}
+	listed, err := listHandlers()
+	if err != nil {
+		return err
+	}
+	current := hr.snapshot()
+	for _, entry := range listed {
+		for _, old := range stale {
+			if entry != old {
+				continue
+			}
+			if current[entry] {
+				continue
+			}
+			fmt.Println("Removing stale handler:", entry)
+			if err := unregisterHandler(entry.ContentType, entry.UdpPort); err != nil {
+				fmt.Println("Error removing stale handler:", err)
+			}
+		}
+	}
+	hr.mu.Lock()
+	hr.stale = nil
+	hr.save()
+	hr.mu.Unlock()
+	return nil
+}
+
+// unregisterAll unregisters every recorded handler.
+func (hr *HandlerRegistry) unregisterAll() {
+	for entry := range hr.snapshot() {
+		err := unregisterHandler(entry.ContentType, entry.UdpPort)
+		if err != nil {
+			fmt.Println("Error unregistering handler", entry, ":", err)
+		}
+	}
+}
+
+// listHandlers fetches every page of UpperDistributor_listHandlers.
+func listHandlers() ([]HandlerEntry, error) {
+	if cjdns.Admin == nil {
+		return nil, errors.New("CJDNS connection is nil")
+	}
+	var entries []HandlerEntry
+	err := cjdns.Admin.CallPaged("UpperDistributor_listHandlers", nil, func(response map[string]interface{}) error {
+		var page struct {
+			Handlers []HandlerEntry `bencode:"handlers"`
+		}
+		if err := decodeAdminReply(response, &page); err != nil {
+			return err
+		}
+		entries = append(entries, page.Handlers...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// useFakeRegistry points cjdns.Admin at a fake cjdroute listing listed and
+// empties the handler registry, restoring both when t ends.
+func useFakeRegistry(t *testing.T, listed []HandlerEntry) *fakeCjdroute {
+	fake := newFakeCjdroute(t, "")
+	fake.handlers = append(fake.handlers, listed...)
+	ac := NewAdminClient(fake)
+	savedAdmin := cjdns.Admin
+	cjdns.Admin = ac
+	handlers.mu.Lock()
+	saved, savedPath, savedStale := handlers.handlers, handlers.path, handlers.stale
+	handlers.handlers, handlers.path, handlers.stale = make(map[HandlerEntry]bool), "", nil
+	handlers.mu.Unlock()
+	t.Cleanup(func() {
+		ac.Close()
+		cjdns.Admin = savedAdmin
+		handlers.mu.Lock()
+		handlers.handlers, handlers.path, handlers.stale = saved, savedPath, savedStale
+		handlers.mu.Unlock()
+	})
+	return fake
+}
+
+func sortedEntries(entries []HandlerEntry) string {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].UdpPort != entries[j].UdpPort {
+			return entries[i].UdpPort < entries[j].UdpPort
+		}
+		return entries[i].ContentType < entries[j].ContentType
+	})
+	return fmt.Sprint(entries)
+}
+
+func TestReplayRegistersOnlyMissing(t *testing.T) {
+	tests := []struct {
+		name   string
+		listed []HandlerEntry
+		want   []HandlerEntry
+	}{
+		{"restarted", nil, []HandlerEntry{{258, 1}, {256, 2}, {258, 2}}},
+		{"still registered", []HandlerEntry{{258, 1}, {256, 2}, {258, 2}}, []HandlerEntry{{258, 1}, {256, 2}, {258, 2}}},
+		{"partly lost", []HandlerEntry{{256, 2}}, []HandlerEntry{{258, 1}, {256, 2}, {258, 2}}},
+		{"with others", []HandlerEntry{{258, 9}}, []HandlerEntry{{258, 1}, {256, 2}, {258, 2}, {258, 9}}},
+	}
+	for _, tt := range tests {
+		fake := useFakeRegistry(t, tt.listed)
+		handlers.mu.Lock()
+		for _, entry := range []HandlerEntry{{258, 1}, {256, 2}, {258, 2}} {
+			handlers.handlers[entry] = true
+		}
+		handlers.mu.Unlock()
+
+		handlers.replay()
+		fake.mu.Lock()
+		got := sortedEntries(append([]HandlerEntry(nil), fake.handlers...))
+		fake.mu.Unlock()
+		if want := sortedEntries(tt.want); got != want {
+			t.Errorf("%s: cjdroute lists %s after replay, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string // "" for no file
+		listed  []HandlerEntry
+		current []HandlerEntry
+		down    bool
+		want    []HandlerEntry // still listed by cjdroute afterwards
+		saved   []HandlerEntry // left in the state file
+	}{
+		{
+			name: "no file",
+			want: nil, saved: nil,
+		},
+		{
+			name:   "stale entries removed",
+			file:   `[{"contentType":258,"udpPort":1},{"contentType":256,"udpPort":7}]`,
+			listed: []HandlerEntry{{258, 1}, {256, 7}, {258, 9}},
+			want:   []HandlerEntry{{258, 9}},
+			saved:  nil,
+		},
+		{
+			name:   "stale entries cjdroute forgot",
+			file:   `[{"contentType":258,"udpPort":1}]`,
+			listed: []HandlerEntry{{258, 9}},
+			want:   []HandlerEntry{{258, 9}},
+			saved:  nil,
+		},
+		{
+			name:    "live entries kept",
+			file:    `[{"contentType":258,"udpPort":1},{"contentType":256,"udpPort":2}]`,
+			listed:  []HandlerEntry{{258, 1}, {256, 2}},
+			current: []HandlerEntry{{256, 2}},
+			want:    []HandlerEntry{{256, 2}},
+			saved:   []HandlerEntry{{256, 2}},
+		},
+		{
+			name:   "cjdroute unreachable",
+			file:   `[{"contentType":258,"udpPort":1},{"contentType":256,"udpPort":7}]`,
+			listed: []HandlerEntry{{258, 1}, {256, 7}},
+			down:   true,
+			want:   []HandlerEntry{{258, 1}, {256, 7}},
+			saved:  []HandlerEntry{{258, 1}, {256, 7}},
+		},
+		{
+			name:   "unreadable file",
+			file:   `{not json`,
+			listed: []HandlerEntry{{258, 1}},
+			want:   []HandlerEntry{{258, 1}},
+			saved:  nil,
+		},
+	}
+	for _, tt := range tests {
+		fake := useFakeRegistry(t, tt.listed)
+		if tt.down {
+			fake.ignore = "UpperDistributor_listHandlers"
+			cjdns.Admin.Timeout = 20 * time.Millisecond
+		}
+		path := filepath.Join(t.TempDir(), "handlers.json")
+		if tt.file != "" {
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		handlers.mu.Lock()
+		for _, entry := range tt.current {
+			handlers.handlers[entry] = true
+		}
+		handlers.mu.Unlock()
+
+		err := handlers.reconcile(path)
+		if tt.down != (err != nil) {
+			t.Errorf("%s: reconcile = %v", tt.name, err)
+		}
+		fake.mu.Lock()
+		got := sortedEntries(append([]HandlerEntry(nil), fake.handlers...))
+		fake.mu.Unlock()
+		if want := sortedEntries(tt.want); got != want {
+			t.Errorf("%s: cjdroute lists %s, want %s", tt.name, got, want)
+		}
+		var saved []HandlerEntry
+		if bytes, err := ioutil.ReadFile(path); err != nil || json.Unmarshal(bytes, &saved) != nil {
+			t.Errorf("%s: state file unreadable: %v", tt.name, err)
+		}
+		if got, want := sortedEntries(saved), sortedEntries(tt.saved); got != want {
+			t.Errorf("%s: state file holds %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestReplayRemovesStaleLater(t *testing.T) {
+	fake := useFakeRegistry(t, []HandlerEntry{{258, 1}})
+	fake.ignore = "UpperDistributor_listHandlers"
+	cjdns.Admin.Timeout = 20 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "handlers.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"contentType":258,"udpPort":1}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := handlers.reconcile(path); err == nil {
+		t.Fatal("reconcile succeeded without listHandlers")
+	}
+	registerHandler(256, 2)
+
+	fake.mu.Lock()
+	fake.ignore = ""
+	fake.mu.Unlock()
+	handlers.replay()
+	fake.mu.Lock()
+	got := sortedEntries(append([]HandlerEntry(nil), fake.handlers...))
+	fake.mu.Unlock()
+	if want := sortedEntries([]HandlerEntry{{256, 2}}); got != want {
+		t.Fatalf("cjdroute lists %s after replay, want %s", got, want)
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytes) != `[{"contentType":256,"udpPort":2}]` {
+		t.Fatalf("state file holds %s", bytes)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// cjdns strips the IPv6 header from tun traffic, the content type is its
+// next header and the payload starts at that layer.
+func isIP6ContentType(contentType uint16) bool {
+	return contentType <= ContentType_IP6_RAW
+}
+
+// decodeIP6 parses payload as gopacket layers starting at the protocol
+// contentType names. Protocols gopacket does not know come back as a
+// single payload layer. Only a broken TCP, UDP or ICMPv6 header is an
+// error, gopacket also guesses at application layers from port numbers.
+func decodeIP6(contentType uint16, payload []byte) (gopacket.Packet, error) {
+	var first gopacket.DecodingLayer
+	switch contentType {
+	case ContentType_IP6_TCP:
+		first = &layers.TCP{}
+	case ContentType_IP6_UDP:
+		first = &layers.UDP{}
+	case ContentType_IP6_ICMP6:
+		first = &layers.ICMPv6{}
+	}
+	if first != nil {
+		if err := first.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil, decodeErr("IP6 "+layers.IPProtocol(contentType).String(), ErrBadPayload, "%v", err)
+		}
+	}
+	return gopacket.NewPacket(payload, layers.IPProtocol(contentType), gopacket.DecodeOptions{NoCopy: true}), nil
+}
+
+// IP6Packet returns the layers of an IP6 content type message, decoding
+// them now unless decode already did.
+func (msg *Message) IP6Packet() (gopacket.Packet, error) {
+	if packet, ok := msg.Content.(gopacket.Packet); ok {
+		return packet, nil
+	}
+	if msg.RouteHeader.IsCtrl || !isIP6ContentType(msg.DataHeader.ContentType) {
+		return nil, decodeErr("IP6", ErrUnknownType, "content type %d", messageContentType(msg))
+	}
+	return decodeIP6(msg.DataHeader.ContentType, msg.ContentBytes)
+}
+
+// UDP is the UDP layer of msg, or nil.
+func (msg *Message) UDP() *layers.UDP {
+	packet, err := msg.IP6Packet()
+	if err != nil {
+		return nil
+	}
+	udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	return udp
+}
+
+// TCP is the TCP layer of msg, or nil.
+func (msg *Message) TCP() *layers.TCP {
+	packet, err := msg.IP6Packet()
+	if err != nil {
+		return nil
+	}
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	return tcp
+}
+
+// ICMPv6 is the ICMPv6 layer of msg, or nil.
+func (msg *Message) ICMPv6() *layers.ICMPv6 {
+	packet, err := msg.IP6Packet()
+	if err != nil {
+		return nil
+	}
+	icmp, _ := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	return icmp
+}
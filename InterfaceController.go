@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// PeerStats is one entry of InterfaceController_peerStats.
+type PeerStats struct {
+	Addr               string `bencode:"addr"`
+	LLAddr             string `bencode:"lladdr"`
+	PublicKey          string `bencode:"publicKey"`
+	SwitchLabel        string `bencode:"switchLabel"`
+	Version            int64  `bencode:"version"`
+	State              string `bencode:"state"`
+	User               string `bencode:"user"`
+	IfNum              int64  `bencode:"ifNum"`
+	IsIncoming         int64  `bencode:"isIncoming"`
+	BytesIn            int64  `bencode:"bytesIn"`
+	BytesOut           int64  `bencode:"bytesOut"`
+	RecvKbps           int64  `bencode:"recvKbps"`
+	SendKbps           int64  `bencode:"sendKbps"`
+	Duplicates         int64  `bencode:"duplicates"`
+	LostPackets        int64  `bencode:"lostPackets"`
+	ReceivedOutOfRange int64  `bencode:"receivedOutOfRange"`
+	Last               int64  `bencode:"last"`
+}
+
+// LastSeen is the time the last packet was received from the peer.
+func (ps *PeerStats) LastSeen() time.Time {
+	return time.UnixMilli(ps.Last)
+}
+
+// fillFromAddr fills PublicKey, SwitchLabel and Version from an address of
+// the form v<version>.<label>.<pubkey>.k, as newer cjdns only sends addr.
+func (ps *PeerStats) fillFromAddr() {
+	version, label, key, ok := parseAddr(ps.Addr)
+	if !ok {
+		return
+	}
+	if ps.Version == 0 {
+		ps.Version = version
+	}
+	if ps.SwitchLabel == "" {
+		ps.SwitchLabel = label
+	}
+	if ps.PublicKey == "" {
+		ps.PublicKey = key
+	}
+}
+
+// peerStats fetches every page of InterfaceController_peerStats.
+func peerStats() ([]PeerStats, error) {
+	if cjdns.Admin == nil {
+		return nil, errors.New("CJDNS connection is nil")
+	}
+	var peers []PeerStats
+	err := cjdns.Admin.CallPaged("InterfaceController_peerStats", nil, func(response map[string]interface{}) error {
+		var page struct {
+			Peers []PeerStats `bencode:"peers"`
+		}
+		if err := decodeAdminReply(response, &page); err != nil {
+			return err
+		}
+		peers = append(peers, page.Peers...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range peers {
+		peers[i].fillFromAddr()
+	}
+	return peers, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zeebo/bencode"
+)
+
+const iptunDefaultHopLimit = 64
+
+// IpTunnel control messages, such as IpTunnel_getAddresses, travel as
+// bencoded UDP from port 0 to port 0 of this address.
+var iptunControlAddr = net.ParseIP("fc00::1")
+
+// IptunPacket is the IPv4 or IPv6 packet carried by a ContentType_IPTUN
+// message.
+type IptunPacket struct {
+	Version  int
+	Src      net.IP
+	Dst      net.IP
+	Protocol layers.IPProtocol
+	Packet   gopacket.Packet
+	// Control is the decoded bencode of an IpTunnel control message.
+	Control map[string]interface{}
+}
+
+// parseIptun decodes content as an IP packet, picking the version from
+// its first nibble.
+func parseIptun(content []byte) (*IptunPacket, error) {
+	if len(content) == 0 {
+		return nil, decodeErr("IPTUN", ErrRunt, "empty")
+	}
+	tun := &IptunPacket{Version: int(content[0] >> 4)}
+	switch tun.Version {
+	case 4:
+		ip4 := &layers.IPv4{}
+		if err := ip4.DecodeFromBytes(content, gopacket.NilDecodeFeedback); err != nil {
+			return nil, decodeErr("IPTUN IPv4", ErrBadPayload, "%v", err)
+		}
+		tun.Src, tun.Dst, tun.Protocol = ip4.SrcIP, ip4.DstIP, ip4.Protocol
+		tun.Packet = gopacket.NewPacket(content, layers.LayerTypeIPv4, gopacket.DecodeOptions{NoCopy: true})
+	case 6:
+		ip6 := &layers.IPv6{}
+		if err := ip6.DecodeFromBytes(content, gopacket.NilDecodeFeedback); err != nil {
+			return nil, decodeErr("IPTUN IPv6", ErrBadPayload, "%v", err)
+		}
+		tun.Src, tun.Dst, tun.Protocol = ip6.SrcIP, ip6.DstIP, ip6.NextHeader
+		tun.Packet = gopacket.NewPacket(content, layers.LayerTypeIPv6, gopacket.DecodeOptions{NoCopy: true})
+	default:
+		return nil, decodeErr("IPTUN", ErrBadPayload, "IP version %d", tun.Version)
+	}
+	if udp, ok := tun.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok && tun.isControl(udp) {
+		if err := bencode.DecodeBytes(udp.Payload, &tun.Control); err != nil {
+			return nil, decodeErr("IPTUN control", ErrBadPayload, "%v", err)
+		}
+	}
+	return tun, nil
+}
+
+func (tun *IptunPacket) isControl(udp *layers.UDP) bool {
+	return tun.Version == 6 && tun.Dst.Equal(iptunControlAddr) && udp.SrcPort == 0 && udp.DstPort == 0
+}
+
+// IptunPacket returns the tunneled packet of msg, decoding it now unless
+// decode already did.
+func (msg *Message) IptunPacket() (*IptunPacket, error) {
+	if tun, ok := msg.Content.(*IptunPacket); ok {
+		return tun, nil
+	}
+	if msg.RouteHeader.IsCtrl || msg.DataHeader.ContentType != ContentType_IPTUN {
+		return nil, decodeErr("IPTUN", ErrUnknownType, "content type %d", messageContentType(msg))
+	}
+	return parseIptun(msg.ContentBytes)
+}
+
+// buildIptunPacket serializes an IP packet from src to dst around the
+// given layers, IPv4 or IPv6 depending on the addresses. Lengths and
+// checksums are filled in.
+func buildIptunPacket(src net.IP, dst net.IP, protocol layers.IPProtocol, payload ...gopacket.SerializableLayer) ([]byte, error) {
+	var network gopacket.NetworkLayer
+	var ipLayer gopacket.SerializableLayer
+	if src.To4() != nil && dst.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: iptunDefaultHopLimit, Protocol: protocol, SrcIP: src.To4(), DstIP: dst.To4()}
+		network, ipLayer = ip4, ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: iptunDefaultHopLimit, NextHeader: protocol, SrcIP: src.To16(), DstIP: dst.To16()}
+		network, ipLayer = ip6, ip6
+	}
+	for _, layer := range payload {
+		if transport, ok := layer.(interface {
+			SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+		}); ok {
+			if err := transport.SetNetworkLayerForChecksum(network); err != nil {
+				return nil, err
+			}
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{ipLayer}, payload...)...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildIptunControl wraps a bencoded IpTunnel control message, such as
+// {"q": "IpTunnel_getAddresses", "txid": ...}, in its UDP packet.
+func buildIptunControl(src net.IP, msg map[string]interface{}) ([]byte, error) {
+	encoded, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	return buildIptunPacket(src, iptunControlAddr, layers.IPProtocolUDP, &layers.UDP{}, gopacket.Payload(encoded))
+}
+
+// createIptunMessage wraps the IP packet in the headers for dest, checking
+// first that it decodes.
+func createIptunMessage(dest Destination, packet []byte) ([]byte, error) {
+	if _, err := parseIptun(packet); err != nil {
+		return nil, err
+	}
+	message := Message{
+		RouteHeader: RouteHeader{
+			PublicKey: dest.PublicKey,
+			Version:   dest.Version,
+			IP:        net.ParseIP(dest.IP),
+			SwitchHeader: SwitchHeader{
+				Label:   dest.Label,
+				Version: currentVer,
+			},
+		},
+		DataHeader: DataHeader{
+			ContentType: ContentType_IPTUN,
+			Version:     1,
+		},
+		ContentBytes: packet,
+	}
+	return message.encode()
+}
+
+// sendIptun injects packet into the tunnel towards dest.
+func sendIptun(dest Destination, packet []byte) error {
+	payload, err := createIptunMessage(dest, packet)
+	if err != nil {
+		return err
+	}
+	sender, err := getSender(ContentType_IPTUN)
+	if err != nil {
+		return err
+	}
+	return sender.Send(payload)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// ErrLabelTooLong is returned when a splice would not fit in 64 bits.
+var ErrLabelTooLong = errors.New("spliced label does not fit in 64 bits")
+
+// Label is a cjdns switch label: director bits read from the least
+// significant end, terminated by a single 1 bit.
+type Label uint64
+
+// ParseLabel parses the dotted form used by cjdns, e.g. 0000.0000.0000.0013.
+func ParseLabel(s string) (Label, error) {
+	groups := strings.Split(s, ".")
+	if len(groups) != 4 {
+		return 0, fmt.Errorf("label %q must have 4 groups", s)
+	}
+	for _, g := range groups {
+		if len(g) != 4 {
+			return 0, fmt.Errorf("label %q must have 4 hex digits per group", s)
+		}
+	}
+	b, err := hex.DecodeString(strings.Join(groups, ""))
+	if err != nil {
+		return 0, fmt.Errorf("label %q is not hex: %v", s, err)
+	}
+	return Label(binary.BigEndian.Uint64(b)), nil
+}
+
+func (l Label) String() string {
+	v := uint64(l)
+	return fmt.Sprintf("%04x.%04x.%04x.%04x", v>>48, (v>>32)&0xffff, (v>>16)&0xffff, v&0xffff)
+}
+
+// Valid reports whether l has a terminating 1 bit, label 0 leaves routing
+// to cjdns and is not a path.
+func (l Label) Valid() bool {
+	return l != 0
+}
+
+// bitsUsed is the position of the terminating bit, log2 of l.
+func (l Label) bitsUsed() int {
+	return bits.Len64(uint64(l)) - 1
+}
+
+// Splice returns the path that follows via to its end and then goes on
+// along l, as seen from the end of via.
+func (l Label) Splice(via Label) (Label, error) {
+	if !l.Valid() || !via.Valid() {
+		return 0, errors.New("cannot splice label 0")
+	}
+	if l.bitsUsed()+via.bitsUsed() > 59 {
+		return 0, ErrLabelTooLong
+	}
+	return Label(((uint64(l) ^ 1) << uint(via.bitsUsed())) ^ uint64(via)), nil
+}
+
+// Unsplice removes the mid path from the front of l, giving the path from
+// the end of mid to the end of l. mid must route through l.
+func (l Label) Unsplice(mid Label) (Label, error) {
+	if !l.RoutesThrough(mid) {
+		return 0, fmt.Errorf("%s does not route through %s", l, mid)
+	}
+	return l >> uint(mid.bitsUsed()), nil
+}
+
+// RoutesThrough reports whether l passes through the node at the end of mid.
+func (l Label) RoutesThrough(mid Label) bool {
+	if mid > l {
+		return false
+	}
+	if mid < 2 {
+		return true
+	}
+	mask := ^uint64(0) >> uint(64-mid.bitsUsed())
+	return uint64(l)&mask == uint64(mid)&mask
+}
+
+// IsOneHop reports whether l leads to a direct peer, assuming the
+// v358 encoding scheme that cjdns uses by default.
+func (l Label) IsOneHop() bool {
+	return SchemeV358.IsOneHop(l)
+}
+
+// Reverse bit reverses l, which is what the switch does to turn the label
+// of a received packet into the path back to its sender.
+func (l Label) Reverse() Label {
+	return Label(bits.Reverse64(uint64(l)))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseLabel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Label
+		ok   bool
+	}{
+		{"0000.0000.0000.0013", 0x13, true},
+		{"0000.0000.0000.0001", 1, true},
+		{"ffff.ffff.ffff.ffff", 0xffffffffffffffff, true},
+		{"0123.4567.89ab.cdef", 0x0123456789abcdef, true},
+		{"0000.0000.0013", 0, false},
+		{"0000.0000.0000.013", 0, false},
+		{"0000.0000.0000.001g", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseLabel(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseLabel(%q) = %s, %v", tt.in, got, err)
+			continue
+		}
+		if tt.ok && got.String() != tt.in {
+			t.Errorf("ParseLabel(%q).String() = %s", tt.in, got)
+		}
+	}
+}
+
+// Splice is ((l ^ 1) << log2(via)) ^ via, so 0x04 (100) onto 0x10 (10000)
+// is 1000000: the director bits of via, then those of l.
+func TestLabelSplice(t *testing.T) {
+	tests := []struct {
+		l, via Label
+		want   Label
+		err    bool
+	}{
+		{0x04, 0x10, 0x40, false},
+		{0x13, 0x15, 0x135, false},
+		{0x13, 0x01, 0x13, false},
+		{0x01, 0x13, 0x13, false},
+		{0x400, 0x13, 0x4003, false},
+		{1 << 30, 1 << 29, 1 << 59, false},
+		{1 << 40, 1 << 20, 0, true},
+		{0, 0x13, 0, true},
+		{0x13, 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.l.Splice(tt.via)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%s.Splice(%s) = %s, %v, want %s", tt.l, tt.via, got, err, tt.want)
+		}
+	}
+	if _, err := Label(1 << 40).Splice(1 << 20); !errors.Is(err, ErrLabelTooLong) {
+		t.Errorf("long splice error = %v, want ErrLabelTooLong", err)
+	}
+}
+
+func TestLabelRoutesThroughAndUnsplice(t *testing.T) {
+	tests := []struct {
+		l, mid  Label
+		through bool
+		rest    Label
+	}{
+		{0x135, 0x15, true, 0x13},
+		{0x135, 0x01, true, 0x135},
+		{0x135, 0x135, true, 0x01},
+		{0x135, 0x13, false, 0},
+		{0x13, 0x135, false, 0},
+		{0x40, 0x10, true, 0x04},
+		{0x4003, 0x13, true, 0x400},
+	}
+	for _, tt := range tests {
+		if got := tt.l.RoutesThrough(tt.mid); got != tt.through {
+			t.Errorf("%s.RoutesThrough(%s) = %v", tt.l, tt.mid, got)
+		}
+		rest, err := tt.l.Unsplice(tt.mid)
+		if (err == nil) != tt.through || rest != tt.rest {
+			t.Errorf("%s.Unsplice(%s) = %s, %v, want %s", tt.l, tt.mid, rest, err, tt.rest)
+		}
+		if tt.through && tt.mid > 1 {
+			if back, err := rest.Splice(tt.mid); err != nil || back != tt.l {
+				t.Errorf("%s.Splice(%s) = %s, %v, want %s", rest, tt.mid, back, err, tt.l)
+			}
+		}
+	}
+}
+
+func TestLabelIsOneHop(t *testing.T) {
+	tests := []struct {
+		l    Label
+		want bool
+	}{
+		{0x13, true},
+		{0x1f, true},
+		{0x82, true},
+		{0xfe, true},
+		{0x400, true},
+		{0x7fc, true},
+		{0x135, false},
+		{0x4003, false},
+		{0x03, false},
+		{0, false},
+	}
+	for _, tt := range tests {
+		if got := tt.l.IsOneHop(); got != tt.want {
+			t.Errorf("%s.IsOneHop() = %v", tt.l, got)
+		}
+	}
+}
+
+func TestLabelReverse(t *testing.T) {
+	tests := []struct{ l, want Label }{
+		{0x13, 0xc800000000000000},
+		{0x01, 0x8000000000000000},
+		{0x8000000000000000, 0x01},
+	}
+	for _, tt := range tests {
+		if got := tt.l.Reverse(); got != tt.want {
+			t.Errorf("%s.Reverse() = %s, want %s", tt.l, got, tt.want)
+		}
+		if got := tt.l.Reverse().Reverse(); got != tt.l {
+			t.Errorf("%s reversed twice = %s", tt.l, got)
+		}
+	}
+}
@@ -2,12 +2,48 @@ package main
 
 import (
 	"bytes"
-	"encoding/hex"
+	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/zeebo/bencode"
 )
 
+// Decoding errors wrap one of these, test with errors.Is.
+var (
+	ErrRunt        = errors.New("runt")
+	ErrBadChecksum = errors.New("bad checksum")
+	ErrBadAddress  = errors.New("bad address")
+	ErrBadMagic    = errors.New("bad magic")
+	ErrUnknownType = errors.New("unknown type")
+	ErrBadPayload  = errors.New("bad payload")
+)
+
+// DecodeError says which part of a packet failed to decode and why.
+type DecodeError struct {
+	Layer  string
+	Err    error
+	Detail string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Detail == "" {
+		return e.Layer + ": " + e.Err.Error()
+	}
+	return e.Layer + ": " + e.Err.Error() + ": " + e.Detail
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func decodeErr(layer string, err error, format string, args ...interface{}) error {
+	return &DecodeError{Layer: layer, Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Message is a decoded UpperDistributor frame. Content holds the typed
+// payload: a *CtrlMsg, *CjdhtMsg, *IptunPacket, *Fragment, or a
+// gopacket.Packet for IP6 content types when cjdns.DecodeIP6 is set.
 type Message struct {
 	RouteHeader  RouteHeader
 	DataHeader   DataHeader
@@ -37,34 +73,40 @@ func (msg *Message) encode() ([]byte, error) {
 		buf.Write(dataHeaderBytes)
 	}
 
-	// Write content bytes
+	// Write content bytes. RawBytes is the frame as received and decoded
+	// Content is a view of ContentBytes, so neither is written again.
 	buf.Write(msg.ContentBytes)
-	buf.Write(msg.RawBytes)
-	bencBytes, ok := msg.ContentBenc.([]byte)
-	if !ok {
-		fmt.Println("Error converting bencode to bytes")
-	} else {
+	if bencBytes, ok := msg.ContentBenc.([]byte); ok {
 		buf.Write(bencBytes)
 	}
-	contentBytes, ok := msg.Content.([]byte)
-	if !ok {
-		fmt.Println("Error converting content to bytes")
-	} else {
+	if contentBytes, ok := msg.Content.([]byte); ok {
 		buf.Write(contentBytes)
 	}
 
 	return buf.Bytes(), nil
 }
 
-func decode(bytes []byte) (Message, error) {
+// CoinType is the application prefix of a RESERVED message, PKT messages
+// carry coinType. It is 0 for other content types.
+func (msg *Message) CoinType() uint32 {
+	if msg.RouteHeader.IsCtrl || msg.DataHeader.ContentType != ContentType_RESERVED || len(msg.ContentBytes) < len(coinType) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(msg.ContentBytes)
+}
+
+func decode(raw []byte) (Message, error) {
 	x := 0
-	routeHeaderBytes := bytes[x:RouteHeaderSize]
+	if len(raw) < RouteHeaderSize {
+		return Message{}, decodeErr("RouteHeader", ErrRunt, "%d bytes", len(raw))
+	}
+	routeHeaderBytes := raw[x:RouteHeaderSize]
 	// fmt.Println("Route Header Bytes:", routeHeaderBytes)
 	x += RouteHeaderSize
 	routeHeader := RouteHeader{}
 	routeHeader, err := routeHeader.parse(routeHeaderBytes)
 	if err != nil {
-		fmt.Println("Error parsing route header: ", err)
+		return Message{}, err
 	}
 
 	// fmt.Println("Route Header:", routeHeader)
@@ -72,36 +114,68 @@ func decode(bytes []byte) (Message, error) {
 	var dataHeaderBytes []byte = nil
 	var dataHeader DataHeader = DataHeader{}
 	if !routeHeader.IsCtrl {
-		dataHeaderBytes = bytes[x : x+DataHeaderSize]
+		if len(raw) < x+DataHeaderSize {
+			return Message{}, decodeErr("DataHeader", ErrRunt, "%d bytes", len(raw)-x)
+		}
+		dataHeaderBytes = raw[x : x+DataHeaderSize]
 		x += DataHeaderSize
 		dataHeader, err = dataHeader.parse(dataHeaderBytes)
 		if err != nil {
-			fmt.Println("Error parsing data header: ", err)
+			return Message{}, err
 		}
 		//fmt.Println("Data Header:", dataHeader)
 	}
-	dataBytes := bytes[x:]
+	dataBytes := raw[x:]
 
 	var decodedBytes interface{} = nil
 	var content interface{} = nil
-	if dataHeader.ContentType == ContentType_RESERVED {
-		coinType := dataBytes[:4]
-		if hex.EncodeToString(coinType) == "80000186" {
-			fmt.Println("coinType is PKT")
+	if routeHeader.IsCtrl {
+		content, err = parseCtrl(dataBytes)
+		if err != nil {
+			return Message{}, err
+		}
+	} else if dataHeader.ContentType == ContentType_RESERVED {
+		if len(dataBytes) < len(coinType) {
+			return Message{}, decodeErr("RESERVED", ErrRunt, "%d bytes", len(dataBytes))
+		}
+		isPKT := bytes.Equal(dataBytes[:len(coinType)], coinType)
+		if isPKT && isFragment(dataBytes[4:]) {
+			content, err = parseFragment(dataBytes[4:])
+			if err != nil {
+				return Message{}, err
+			}
+		} else if err := bencode.DecodeBytes(dataBytes[4:], &decodedBytes); err != nil {
+			// Other applications' payloads need not be bencode, ours are.
+			if isPKT {
+				return Message{}, decodeErr("RESERVED", ErrBadPayload, "%v", err)
+			}
+			decodedBytes = nil
+		}
+	} else if dataHeader.ContentType == ContentType_IPTUN {
+		content, err = parseIptun(dataBytes)
+		if err != nil {
+			return Message{}, err
+		}
+	} else if cjdns.DecodeIP6 && isIP6ContentType(dataHeader.ContentType) {
+		content, err = decodeIP6(dataHeader.ContentType, dataBytes)
+		if err != nil {
+			return Message{}, err
 		}
-		bencode.DecodeBytes(dataBytes[4:], &decodedBytes)
 	} else if dataHeader.ContentType == ContentType_CJDHT {
-		bencode.DecodeBytes(dataBytes, &decodedBytes)
-		fmt.Println("Bencode content:", decodedBytes)
-	} else if routeHeader.IsCtrl {
-		content, _ = parseCtrl(dataBytes)
+		if err := bencode.DecodeBytes(dataBytes, &decodedBytes); err != nil {
+			return Message{}, decodeErr("CJDHT", ErrBadPayload, "%v", err)
+		}
+		content, err = parseCjdht(dataBytes)
+		if err != nil {
+			return Message{}, err
+		}
 	}
 
 	return Message{
 		RouteHeader:  routeHeader,
 		DataHeader:   dataHeader,
 		ContentBytes: dataBytes,
-		RawBytes:     bytes,
+		RawBytes:     raw,
 		ContentBenc:  decodedBytes,
 		Content:      content,
 	}, nil
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// MessageView reads the headers of a message in place, without copying or
+// decoding it. It is only valid as long as the buffer it views.
+type MessageView []byte
+
+// ViewMessage checks that b is long enough to hold its headers and returns
+// a view over it.
+func ViewMessage(b []byte) (MessageView, error) {
+	if len(b) < RouteHeaderSize {
+		return nil, decodeErr("RouteHeader", ErrRunt, "%d bytes", len(b))
+	}
+	v := MessageView(b)
+	if !v.IsCtrl() && len(b) < RouteHeaderSize+DataHeaderSize {
+		return nil, decodeErr("DataHeader", ErrRunt, "%d bytes", len(b)-RouteHeaderSize)
+	}
+	return v, nil
+}
+
+// KeyBytes is the 32 byte public key of the other end.
+func (v MessageView) KeyBytes() []byte {
+	return v[0:32]
+}
+
+// PublicKey is KeyBytes in .k form, see keyBytesToString.
+func (v MessageView) PublicKey() string {
+	return keyBytesToString(v.KeyBytes())
+}
+
+func (v MessageView) SwitchHeaderBytes() []byte {
+	return v[32:44]
+}
+
+func (v MessageView) Label() Label {
+	return Label(binary.BigEndian.Uint64(v[32:40]))
+}
+
+func (v MessageView) Version() uint32 {
+	return binary.BigEndian.Uint32(v[44:48])
+}
+
+func (v MessageView) Flags() byte {
+	return v[48]
+}
+
+func (v MessageView) IsCtrl() bool {
+	return v.Flags()&F_CTRL != 0
+}
+
+func (v MessageView) IsIncoming() bool {
+	return v.Flags()&F_INCOMING != 0
+}
+
+// IP is the cjdns address of the other end, all zero for CTRL frames.
+func (v MessageView) IP() []byte {
+	return v[52:68]
+}
+
+// ContentType is the UpperDistributor content type, ContentType_CTRL for
+// CTRL frames, like messageContentType.
+func (v MessageView) ContentType() int64 {
+	if v.IsCtrl() {
+		return ContentType_CTRL
+	}
+	return int64(binary.BigEndian.Uint16(v[RouteHeaderSize+2:]))
+}
+
+// Content is everything after the headers.
+func (v MessageView) Content() []byte {
+	if v.IsCtrl() {
+		return v[RouteHeaderSize:]
+	}
+	return v[RouteHeaderSize+DataHeaderSize:]
+}
+
+// IsFragment reports whether v carries one fragment of a larger RESERVED
+// payload.
+func (v MessageView) IsFragment() bool {
+	content := v.Content()
+	return v.ContentType() == ContentType_RESERVED && len(content) >= len(coinType) &&
+		bytes.Equal(content[:len(coinType)], coinType) && isFragment(content[len(coinType):])
+}
+
+// Decode fully decodes a copy of v, so the result outlives the buffer.
+func (v MessageView) Decode() (Message, error) {
+	return decode(append([]byte(nil), v...))
+}
+
+// packetPool holds receive buffers big enough for any datagram.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxDatagramSize)
+		return &buf
+	},
+}
+
+func getPacketBuf() *[]byte {
+	return packetPool.Get().(*[]byte)
+}
+
+func putPacketBuf(buf *[]byte) {
+	packetPool.Put(buf)
+}
+
+// keyStrings caches the .k form of recently seen keys, a busy node hears
+// from far fewer keys than it receives packets.
+var keyStrings = struct {
+	sync.RWMutex
+	m map[[32]byte]string
+}{m: make(map[[32]byte]string)}
+
+const keyStringCacheSize = 4096
+
+func cachedKeyString(keyBytes []byte) string {
+	var key [32]byte
+	copy(key[:], keyBytes)
+	keyStrings.RLock()
+	s, ok := keyStrings.m[key]
+	keyStrings.RUnlock()
+	if ok {
+		return s
+	}
+	s = Base32_encode(keyBytes) + ".k"
+	keyStrings.Lock()
+	if len(keyStrings.m) >= keyStringCacheSize {
+		keyStrings.m = make(map[[32]byte]string)
+	}
+	keyStrings.m[key] = s
+	keyStrings.Unlock()
+	return s
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func benchmarkPacket(b *testing.B) []byte {
+	packet, err := benchPacket()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	return packet
+}
+
+func BenchmarkDecode(b *testing.B) {
+	packet := benchmarkPacket(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := decode(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkViewMessage(b *testing.B) {
+	packet := benchmarkPacket(b)
+	var sink int64
+	for i := 0; i < b.N; i++ {
+		v, err := ViewMessage(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sink += v.ContentType() + int64(v.Label()) + int64(v.Version()) + int64(len(v.Content()))
+	}
+	_ = sink
+}
+
+func BenchmarkViewPublicKey(b *testing.B) {
+	packet := benchmarkPacket(b)
+	for i := 0; i < b.N; i++ {
+		v, _ := ViewMessage(packet)
+		_ = v.PublicKey()
+	}
+}
+
+func BenchmarkRouterView(b *testing.B) {
+	packet := benchmarkPacket(b)
+	var sink int64
+	router := &Router{registered: make(map[int64]bool)}
+	router.routes = []route{{lo: ContentType_RESERVED, hi: ContentType_RESERVED, view: func(v MessageView) {
+		sink += int64(v.Label()) + int64(len(v.Content()))
+	}}}
+	reassembler := NewReassembler()
+	for i := 0; i < b.N; i++ {
+		router.receive(packet, reassembler)
+	}
+	_ = sink
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zeebo/bencode"
+)
+
+// benchPacket is a RESERVED invoice request as it arrives from the
+// UpperDistributor.
+func benchPacket() ([]byte, error) {
+	msg := createInvoiceRequest(1000)
+	msg["txid"] = "bench"
+	encoded, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	return createReservedMessage(benchDestination(), append(append([]byte(nil), coinType...), encoded...), nil)
+}
+
+// benchDestination is a made up peer for synthetic packets.
+func benchDestination() Destination {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i * 7)
+	}
+	return Destination{
+		IP:        "fc00::1234",
+		PublicKey: keyBytesToString(key),
+		Label:     0x13,
+		Version:   defaultRouteVersion,
+	}
+}
+
+// fuzzSeeds are well formed packets of every kind decode understands.
+func fuzzSeeds() ([][]byte, error) {
+	reserved, err := benchPacket()
+	if err != nil {
+		return nil, err
+	}
+	cjdht := append([]byte(nil), reserved[:RouteHeaderSize+DataHeaderSize]...)
+	cjdht[RouteHeaderSize+2], cjdht[RouteHeaderSize+3] = 0x01, 0x00
+	cjdht = append(cjdht, reserved[RouteHeaderSize+DataHeaderSize+len(coinType):]...)
+	seeds := [][]byte{reserved, cjdht}
+
+	peer := benchDestination()
+	for _, dht := range []*CjdhtMsg{
+		NewCjdhtQuery(CJDHT_GET_PEERS, LabelTarget(0x13)),
+		{Txid: "fuzz", Version: defaultRouteVersion, EncodingScheme: SchemeV358, EncodingIndex: 0, Nodes: []DhtNode{
+			{PublicKey: peer.PublicKey, Label: 0x13, Version: defaultRouteVersion},
+			{PublicKey: peer.PublicKey, Label: 0x135, Version: 0x1234},
+		}},
+	} {
+		packet, err := createCjdhtMessage(peer, dht)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, packet)
+	}
+
+	fragments, err := createReservedMessages(benchDestination(), map[string]interface{}{
+		"q":    "fuzz",
+		"txid": "fuzz",
+		"data": strings.Repeat("x", 3*maxContentSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	seeds = append(seeds, fragments...)
+
+	ip6, err := ip6Seeds(peer)
+	if err != nil {
+		return nil, err
+	}
+	seeds = append(seeds, ip6...)
+
+	iptun, err := iptunSeeds(peer)
+	if err != nil {
+		return nil, err
+	}
+	seeds = append(seeds, iptun...)
+
+	ctrls := []*CtrlMsg{
+		{Type: CTRL_PING, Ping: &CtrlPing{Version: switchPingVersion, Data: []byte("01234567")}},
+		{Type: CTRL_KEYPONG, Ping: &CtrlPing{Version: switchPingVersion, Key: benchDestination().PublicKey}},
+		{Type: CTRL_GETSNODE_QUERY, GetSnode: &CtrlGetSnode{Version: switchPingVersion, PathToSnode: 0x13}},
+		{Type: CTRL_RPATH_REPLY, RPath: &CtrlRPath{Version: switchPingVersion, RPath: 0x135}},
+		{Type: CTRL_ERROR, Error: &CtrlError{ErrorType: 1, Cause: SwitchHeader{Label: 0x13, Version: currentVer}}},
+	}
+	for _, ctrl := range ctrls {
+		content, err := ctrl.encode()
+		if err != nil {
+			return nil, err
+		}
+		message := Message{
+			RouteHeader:  RouteHeader{SwitchHeader: SwitchHeader{Label: 0x13, Version: currentVer}, IsCtrl: true},
+			ContentBytes: content,
+		}
+		packet, err := message.encode()
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, packet)
+	}
+	return seeds, nil
+}
+
+// ip6Seeds are UDP, TCP and ICMPv6 frames as cjdns delivers them, with
+// the IPv6 header already stripped.
+func ip6Seeds(dest Destination) ([][]byte, error) {
+	payload := gopacket.Payload("fuzz")
+	frames := []struct {
+		contentType uint16
+		layers      []gopacket.SerializableLayer
+	}{
+		{ContentType_IP6_UDP, []gopacket.SerializableLayer{&layers.UDP{SrcPort: 1234, DstPort: 53}, payload}},
+		{ContentType_IP6_TCP, []gopacket.SerializableLayer{&layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 1, SYN: true, Window: 1024}, payload}},
+		{ContentType_IP6_ICMP6, []gopacket.SerializableLayer{&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}, payload}},
+	}
+	var seeds [][]byte
+	for _, frame := range frames {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, frame.layers...); err != nil {
+			return nil, err
+		}
+		message := Message{
+			RouteHeader: RouteHeader{
+				PublicKey:    dest.PublicKey,
+				Version:      dest.Version,
+				IP:           net.ParseIP(dest.IP),
+				SwitchHeader: SwitchHeader{Label: dest.Label, Version: currentVer},
+			},
+			DataHeader:   DataHeader{ContentType: frame.contentType, Version: 1},
+			ContentBytes: buf.Bytes(),
+		}
+		packet, err := message.encode()
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, packet)
+	}
+	return seeds, nil
+}
+
+// iptunSeeds are IPTUN frames carrying IPv4 and IPv6 traffic and an
+// IpTunnel control query.
+func iptunSeeds(dest Destination) ([][]byte, error) {
+	ip4, err := buildIptunPacket(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), layers.IPProtocolUDP,
+		&layers.UDP{SrcPort: 1234, DstPort: 5678}, gopacket.Payload("fuzz"))
+	if err != nil {
+		return nil, err
+	}
+	ip6, err := buildIptunPacket(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), layers.IPProtocolTCP,
+		&layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 1, SYN: true, Window: 1024})
+	if err != nil {
+		return nil, err
+	}
+	control, err := buildIptunControl(net.ParseIP(dest.IP), map[string]interface{}{"q": "IpTunnel_getAddresses", "txid": "fuzz"})
+	if err != nil {
+		return nil, err
+	}
+	var seeds [][]byte
+	for _, packet := range [][]byte{ip4, ip6, control} {
+		frame, err := createIptunMessage(dest, packet)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, frame)
+	}
+	return seeds, nil
+}
+
+// FuzzDecode checks that no packet makes the decoders panic, that every
+// failure wraps a DecodeError, and that whatever decodes re-encodes to the
+// same bytes.
+func FuzzDecode(f *testing.F) {
+	seeds, err := fuzzSeeds()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	decodeIP6 := cjdns.DecodeIP6
+	cjdns.DecodeIP6 = true
+	f.Cleanup(func() { cjdns.DecodeIP6 = decodeIP6 })
+	reassembler := NewReassembler()
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		checkTyped := func(what string, err error) {
+			var de *DecodeError
+			if err != nil && !errors.As(err, &de) {
+				t.Fatalf("%s: untyped error: %v", what, err)
+			}
+		}
+		view, err := ViewMessage(packet)
+		checkTyped("ViewMessage", err)
+		if err == nil {
+			view.ContentType()
+			view.Label()
+			view.PublicKey()
+			view.IsFragment()
+			if view.IsCtrl() {
+				_, err := parseCtrl(append([]byte(nil), view.Content()...))
+				checkTyped("parseCtrl", err)
+			}
+		}
+		message, err := decode(append([]byte(nil), packet...))
+		checkTyped("decode", err)
+		if err != nil {
+			return
+		}
+		encoded, err := message.encode()
+		if err != nil {
+			t.Fatalf("decoded frame does not encode: %v", err)
+		}
+		if !bytes.Equal(encoded, packet) {
+			t.Fatalf("decoded frame re-encodes as %x", encoded)
+		}
+		reassembler.Add(message)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// Used when the destination cannot be resolved, cjdns then looks the
+	// route up itself.
+	defaultRouteLabel   = Label(0)
+	defaultRouteVersion = 22
+)
+
+// NodeStoreEntry is one entry of NodeStore_dumpTable.
+type NodeStoreEntry struct {
+	IP      string `bencode:"ip"`
+	Addr    string `bencode:"addr"`
+	Path    string `bencode:"path"`
+	Link    int64  `bencode:"link"`
+	Version int64  `bencode:"version"`
+	Time    int64  `bencode:"time"`
+	Bucket  int64  `bencode:"bucket"`
+}
+
+// NodeInfo is the result of NodeStore_nodeForAddr.
+type NodeInfo struct {
+	Key             string         `bencode:"key"`
+	ProtocolVersion int64          `bencode:"protocolVersion"`
+	RouteLabel      string         `bencode:"routeLabel"`
+	LinkCount       int64          `bencode:"linkCount"`
+	Reach           int64          `bencode:"reach"`
+	BestParent      NodeParent     `bencode:"bestParent"`
+	EncodingScheme  EncodingScheme `bencode:"encodingScheme"`
+}
+
+type NodeParent struct {
+	IP               string `bencode:"ip"`
+	ParentChildLabel string `bencode:"parentChildLabel"`
+}
+
+// dumpTable fetches every page of NodeStore_dumpTable.
+func dumpTable() ([]NodeStoreEntry, error) {
+	if cjdns.Admin == nil {
+		return nil, errors.New("CJDNS connection is nil")
+	}
+	var table []NodeStoreEntry
+	err := cjdns.Admin.CallPaged("NodeStore_dumpTable", nil, func(response map[string]interface{}) error {
+		var page struct {
+			RoutingTable []NodeStoreEntry `bencode:"routingTable"`
+		}
+		if err := decodeAdminReply(response, &page); err != nil {
+			return err
+		}
+		table = append(table, page.RoutingTable...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func nodeForAddr(ip string) (NodeInfo, error) {
+	if cjdns.Admin == nil {
+		return NodeInfo{}, errors.New("CJDNS connection is nil")
+	}
+	response, err := cjdns.Admin.Call("NodeStore_nodeForAddr", map[string]interface{}{"ip": ip})
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	var reply struct {
+		Result *NodeInfo `bencode:"result"`
+	}
+	if err := decodeAdminReply(response, &reply); err != nil {
+		return NodeInfo{}, err
+	}
+	if reply.Result == nil {
+		return NodeInfo{}, fmt.Errorf("node %s not found", ip)
+	}
+	return *reply.Result, nil
+}
+
+// getRouteLabel splices pathParentToChild onto pathToParent.
+func getRouteLabel(pathParentToChild string, pathToParent string) (string, error) {
+	if cjdns.Admin == nil {
+		return "", errors.New("CJDNS connection is nil")
+	}
+	args := map[string]interface{}{
+		"pathParentToChild": pathParentToChild,
+		"pathToParent":      pathToParent,
+	}
+	response, err := cjdns.Admin.Call("NodeStore_getRouteLabel", args)
+	if err != nil {
+		return "", err
+	}
+	label, ok := response["result"].(string)
+	if !ok {
+		return "", errors.New("NodeStore_getRouteLabel returned no result")
+	}
+	return label, nil
+}
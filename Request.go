@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	requestMaxAttempts = 5
+	// Replies to retransmitted requests keep arriving after the first one
+	// was delivered, their txids are remembered this long to drop them.
+	requestDuplicateTTL = 1 * time.Minute
+)
+
+// The retransmit backoff, variables so tests need not wait for it.
+var (
+	requestFirstTimeout = 1 * time.Second
+	requestMaxTimeout   = 8 * time.Second
+)
+
+// coinType prefixes every RESERVED payload.
+var coinType = []byte{0x80, 0x00, 0x01, 0x86}
+
+// Destination addresses a cjdns node.
+type Destination struct {
+	IP        string
+	PublicKey string
+	Label     Label
+	Version   int32
+}
+
+// TimeoutError is returned by Request when the peer never answers.
+type TimeoutError struct {
+	Txid     string
+	Attempts int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("no reply to txid %s after %d attempts", e.Txid, e.Attempts)
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// createReservedMessages encodes msg as RESERVED content messages to dest,
+// one datagram unless msg needs fragmenting.
+func createReservedMessages(dest Destination, msg map[string]interface{}) ([][]byte, error) {
+	encodedMsg, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := fragmentContent(encodedMsg)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, 0, len(contents))
+	for _, content := range contents {
+		payload, err := createReservedMessage(dest, content, msg)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+func createReservedMessage(dest Destination, bytesMessage []byte, msg map[string]interface{}) ([]byte, error) {
+	var message Message = Message{
+		RouteHeader: RouteHeader{
+			PublicKey: dest.PublicKey,
+			Version:   dest.Version,
+			IP:        net.ParseIP(dest.IP),
+			SwitchHeader: SwitchHeader{
+				Label:   dest.Label,
+				Version: 1,
+			},
+			IsIncoming: false,
+			IsCtrl:     false,
+		},
+		DataHeader: DataHeader{
+			ContentType: ContentType_RESERVED,
+			Version:     1,
+		},
+		ContentBytes: bytesMessage,
+		RawBytes:     nil,
+		ContentBenc:  msg,
+		Content:      nil,
+	}
+	return message.encode()
+}
+
+// messageTxid is the "txid" of a bencoded message, or "".
+func messageTxid(message *Message) string {
+	benc, ok := message.ContentBenc.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	txid, _ := benc["txid"].(string)
+	return txid
+}
+
+// sentBy reports whether message comes from dest, by its key or, if dest
+// has none, by its address, so another node cannot answer a request.
+func sentBy(message *Message, dest Destination) bool {
+	if dest.PublicKey != "" {
+		return message.RouteHeader.PublicKey == dest.PublicKey
+	}
+	return message.RouteHeader.IP.Equal(net.ParseIP(dest.IP))
+}
+
+// Request sends msg to dest and waits for the RESERVED reply from dest
+// carrying the same txid, retransmitting with backoff. A txid is generated
+// if msg has none. It gives up after requestMaxAttempts, or when ctx is
+// done, with a *TimeoutError.
+func (s *Sender) Request(ctx context.Context, dest Destination, msg map[string]interface{}) (Message, error) {
+	txid, ok := msg["txid"].(string)
+	if !ok || txid == "" {
+		txid = fmt.Sprintf("%d", generateRandomNumber())
+		msg["txid"] = txid
+	}
+	payloads, err := createReservedMessages(dest, msg)
+	if err != nil {
+		return Message{}, err
+	}
+	replies, cancel := s.Expect(func(message *Message) bool {
+		return message.DataHeader.ContentType == ContentType_RESERVED && messageTxid(message) == txid && sentBy(message, dest)
+	})
+	defer cancel()
+	// Marked up front: a duplicate can arrive right after the first reply
+	// was handed over, before this goroutine runs again.
+	s.markDone(txid)
+
+	timeout := requestFirstTimeout
+	attempts := 0
+	for attempts < requestMaxAttempts {
+		for _, payload := range payloads {
+			if err := s.Send(payload); err != nil {
+				return Message{}, err
+			}
+		}
+		attempts++
+		timer := time.NewTimer(timeout)
+		select {
+		case reply, ok := <-replies:
+			timer.Stop()
+			if !ok {
+				return Message{}, ErrSenderClosed
+			}
+			s.markDone(txid)
+			return reply, nil
+		case <-ctx.Done():
+			timer.Stop()
+			if ctx.Err() == context.DeadlineExceeded {
+				return Message{}, &TimeoutError{Txid: txid, Attempts: attempts}
+			}
+			return Message{}, ctx.Err()
+		case <-timer.C:
+		}
+		timeout *= 2
+		if timeout > requestMaxTimeout {
+			timeout = requestMaxTimeout
+		}
+	}
+	s.markDone(txid)
+	return Message{}, &TimeoutError{Txid: txid, Attempts: attempts}
+}
+
+// markDone remembers txid for requestDuplicateTTL so late duplicate
+// replies are dropped quietly.
+func (s *Sender) markDone(txid string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(map[string]time.Time)
+	}
+	for old, expiry := range s.done {
+		if now.After(expiry) {
+			delete(s.done, old)
+		}
+	}
+	s.done[txid] = now.Add(requestDuplicateTTL)
+}
+
+// isDuplicate reports whether message answers a finished request.
+func (s *Sender) isDuplicate(message *Message) bool {
+	txid := messageTxid(message)
+	if txid == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.done[txid]
+	return ok && time.Now().Before(expiry)
+}
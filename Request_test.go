@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loopbackSender is a Sender whose datagrams go to a local peer socket
+// instead of cjdns. answer sees each request by number and returns the
+// replies to send back, as bencoded messages from the given node.
+type loopbackSender struct {
+	*Sender
+	peer *net.UDPConn
+
+	mu    sync.Mutex
+	sent  []time.Time
+	txids []string
+}
+
+type loopbackReply struct {
+	from Destination
+	msg  map[string]interface{}
+}
+
+func newLoopbackSender(t *testing.T, answer func(n int, txid string) []loopbackReply) *loopbackSender {
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	peer, err := net.ListenUDP("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sender{conn: conn, rAddr: peer.LocalAddr().(*net.UDPAddr), contentType: ContentType_RESERVED}
+	go s.readLoop()
+	ls := &loopbackSender{Sender: s, peer: peer}
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := peer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			message, err := decode(append([]byte(nil), buf[:n]...))
+			if err != nil {
+				t.Errorf("request does not decode: %v", err)
+				continue
+			}
+			txid := messageTxid(&message)
+			ls.mu.Lock()
+			ls.sent = append(ls.sent, time.Now())
+			ls.txids = append(ls.txids, txid)
+			count := len(ls.sent)
+			ls.mu.Unlock()
+			for _, reply := range answer(count, txid) {
+				payloads, err := createReservedMessages(reply.from, reply.msg)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				for _, payload := range payloads {
+					peer.WriteToUDP(payload, addr)
+				}
+			}
+		}
+	}()
+	return ls
+}
+
+func fastRetransmits(t *testing.T) {
+	first, max := requestFirstTimeout, requestMaxTimeout
+	requestFirstTimeout, requestMaxTimeout = 20*time.Millisecond, 80*time.Millisecond
+	t.Cleanup(func() { requestFirstTimeout, requestMaxTimeout = first, max })
+}
+
+var (
+	testDest  = Destination{IP: testIP, PublicKey: testPubkey, Label: 0x13, Version: 22}
+	otherDest = Destination{IP: "fc0e:b630:e81e:1e9a:38f1:f83f:f6f7:cb84", PublicKey: "h900000000000000000000000000000000000000000000000000.k"}
+)
+
+func TestRequestRetransmits(t *testing.T) {
+	fastRetransmits(t)
+	ls := newLoopbackSender(t, func(n int, txid string) []loopbackReply {
+		if n < 3 {
+			return nil
+		}
+		// Another node answering first must not complete the request.
+		return []loopbackReply{
+			{otherDest, map[string]interface{}{"txid": txid, "from": "other"}},
+			{testDest, map[string]interface{}{"txid": txid, "from": "dest"}},
+		}
+	})
+
+	reply, err := ls.Request(context.Background(), testDest, map[string]interface{}{"q": "invoice_req"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	benc, _ := reply.ContentBenc.(map[string]interface{})
+	if benc["from"] != "dest" || reply.RouteHeader.PublicKey != testPubkey {
+		t.Fatalf("reply = %v from %s", benc, reply.RouteHeader.PublicKey)
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.sent) != 3 {
+		t.Fatalf("request sent %d times, want 3", len(ls.sent))
+	}
+	if ls.txids[0] == "" || ls.txids[1] != ls.txids[0] || ls.txids[2] != ls.txids[0] {
+		t.Fatalf("retransmits carry txids %v", ls.txids)
+	}
+	if gap1, gap2 := ls.sent[1].Sub(ls.sent[0]), ls.sent[2].Sub(ls.sent[1]); gap1 < requestFirstTimeout/2 || gap2 < 3*requestFirstTimeout/2 {
+		t.Fatalf("retransmitted after %v and %v, want backoff from %v", gap1, gap2, requestFirstTimeout)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	fastRetransmits(t)
+	ls := newLoopbackSender(t, func(int, string) []loopbackReply { return nil })
+
+	_, err := ls.Request(context.Background(), testDest, map[string]interface{}{"q": "invoice_req", "txid": "t1"})
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.Txid != "t1" || timeout.Attempts != requestMaxAttempts {
+		t.Fatalf("Request = %v, want a TimeoutError after %d attempts", err, requestMaxAttempts)
+	}
+	if e, ok := err.(interface{ Timeout() bool }); !ok || !e.Timeout() {
+		t.Fatalf("%v does not report Timeout", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = ls.Request(ctx, testDest, map[string]interface{}{"q": "invoice_req", "txid": "t2"})
+	if !errors.As(err, &timeout) || timeout.Txid != "t2" || timeout.Attempts > 2 {
+		t.Fatalf("Request with a deadline = %v, want a TimeoutError within 2 attempts", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := ls.Request(ctx, testDest, map[string]interface{}{"q": "invoice_req"}); err != context.Canceled {
+		t.Fatalf("canceled Request = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRequestDropsDuplicates(t *testing.T) {
+	s := &Sender{}
+	message := func(from Destination, txid string) *Message {
+		return &Message{
+			RouteHeader: RouteHeader{PublicKey: from.PublicKey, IP: net.ParseIP(from.IP)},
+			DataHeader:  DataHeader{ContentType: ContentType_RESERVED},
+			ContentBenc: map[string]interface{}{"txid": txid},
+		}
+	}
+
+	replies, cancel := s.Expect(func(m *Message) bool {
+		return messageTxid(m) == "a" && sentBy(m, testDest)
+	})
+	defer cancel()
+	if s.deliver(message(otherDest, "a")) {
+		t.Fatal("a reply from another node was delivered")
+	}
+	if !s.deliver(message(testDest, "a")) {
+		t.Fatal("the reply was not delivered")
+	}
+	if got := <-replies; messageTxid(&got) != "a" {
+		t.Fatalf("delivered %v", got.ContentBenc)
+	}
+	s.markDone("a")
+	if s.deliver(message(testDest, "a")) || !s.isDuplicate(message(testDest, "a")) {
+		t.Fatal("a second reply is not a duplicate")
+	}
+	if s.isDuplicate(message(testDest, "b")) || s.isDuplicate(message(testDest, "")) {
+		t.Fatal("unrelated replies count as duplicates")
+	}
+
+	s.mu.Lock()
+	s.done["a"] = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	if s.isDuplicate(message(testDest, "a")) {
+		t.Fatal("an expired txid still counts as a duplicate")
+	}
+	s.markDone("c")
+	if _, ok := s.done["a"]; ok {
+		t.Fatal("markDone kept an expired txid")
+	}
+
+	// Without a key the reply must come from the destination address.
+	noKey := Destination{IP: testIP}
+	if sentBy(message(otherDest, "x"), noKey) || !sentBy(message(testDest, "x"), noKey) {
+		t.Fatal("sentBy does not match by address without a key")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	resolveTTL      = 5 * time.Minute
+	resolveCacheMax = 1024
+	searchTimeout   = 10 * time.Second
+)
+
+type cachedDestination struct {
+	dest    Destination
+	expires time.Time
+}
+
+// ErrBadDestination is returned by Resolve for an address that is not a
+// cjdns address or that does not belong to the given public key.
+var ErrBadDestination = errors.New("invalid cjdns destination")
+
+var (
+	resolveMu    sync.Mutex
+	resolveCache = make(map[string]cachedDestination)
+)
+
+// Resolve fills in whichever of ip and pubkey is missing, plus the switch
+// label and protocol version, from NodeStore or, failing that, a
+// SearchRunner_search. Results are cached for resolveTTL.
+func Resolve(ip string, pubkey string) (Destination, error) {
+	if ip == "" && pubkey == "" {
+		return Destination{}, errors.New("need an IPv6 address or a public key")
+	}
+	if ip == "" {
+		addr, err := publicKeyToIP6(pubkey)
+		if err != nil {
+			return Destination{}, fmt.Errorf("%w: %v", ErrBadDestination, err)
+		}
+		ip = addr.String()
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() != nil || addr[0] != 0xfc {
+		return Destination{}, fmt.Errorf("%w: %q is not an fc00::/8 address", ErrBadDestination, ip)
+	}
+	ip = addr.String()
+	if pubkey != "" {
+		keyIP, err := publicKeyToIP6(pubkey)
+		if err != nil {
+			return Destination{}, fmt.Errorf("%w: %v", ErrBadDestination, err)
+		}
+		if !keyIP.Equal(addr) {
+			return Destination{}, fmt.Errorf("%w: %s belongs to %s, not %s", ErrBadDestination, pubkey, keyIP, ip)
+		}
+	}
+
+	resolveMu.Lock()
+	cached, ok := resolveCache[ip]
+	if ok && !time.Now().Before(cached.expires) {
+		delete(resolveCache, ip)
+		ok = false
+	}
+	resolveMu.Unlock()
+	if ok && (pubkey == "" || pubkey == cached.dest.PublicKey) {
+		return cached.dest, nil
+	}
+
+	dest, err := resolveUncached(ip, pubkey)
+	if err != nil {
+		return Destination{}, err
+	}
+	cacheDestination(ip, dest)
+	return dest, nil
+}
+
+// cacheDestination stores dest for resolveTTL, first dropping expired
+// entries and, if the cache is still full, the one closest to expiring.
+func cacheDestination(ip string, dest Destination) {
+	now := time.Now()
+	resolveMu.Lock()
+	defer resolveMu.Unlock()
+	var oldest string
+	for key, cached := range resolveCache {
+		if !now.Before(cached.expires) {
+			delete(resolveCache, key)
+		} else if oldest == "" || cached.expires.Before(resolveCache[oldest].expires) {
+			oldest = key
+		}
+	}
+	if _, ok := resolveCache[ip]; !ok && len(resolveCache) >= resolveCacheMax {
+		delete(resolveCache, oldest)
+	}
+	resolveCache[ip] = cachedDestination{dest: dest, expires: now.Add(resolveTTL)}
+}
+
+func resolveUncached(ip string, pubkey string) (Destination, error) {
+	dest := Destination{IP: ip, PublicKey: pubkey}
+	node, err := nodeForAddr(ip)
+	if err == nil && node.RouteLabel != "" {
+		dest.Label, err = ParseLabel(node.RouteLabel)
+		if err != nil {
+			return Destination{}, err
+		}
+		dest.Version = int32(node.ProtocolVersion)
+		if dest.PublicKey == "" {
+			dest.PublicKey = node.Key
+		}
+		return dest, nil
+	}
+	table, err := dumpTable()
+	if err == nil {
+		for _, entry := range table {
+			if net.ParseIP(entry.IP).String() != ip {
+				continue
+			}
+			dest.Label, err = ParseLabel(entry.Path)
+			if err != nil {
+				return Destination{}, err
+			}
+			dest.Version = int32(entry.Version)
+			if _, _, key, ok := parseAddr(entry.Addr); ok && dest.PublicKey == "" {
+				dest.PublicKey = key
+			}
+			return dest, nil
+		}
+	}
+	found, err := search(ip)
+	if err != nil {
+		return Destination{}, err
+	}
+	if dest.PublicKey == "" {
+		dest.PublicKey = found.PublicKey
+	}
+	dest.Label = found.Label
+	dest.Version = found.Version
+	return dest, nil
+}
+
+// search runs SearchRunner_search for ip and returns the first node that
+// answers for it.
+func search(ip string) (Destination, error) {
+	if cjdns.Admin == nil {
+		return Destination{}, errors.New("CJDNS connection is nil")
+	}
+	stream, err := cjdns.Admin.Subscribe("SearchRunner_search", map[string]interface{}{"ipv6": ip})
+	if err != nil {
+		return Destination{}, err
+	}
+	defer stream.Close()
+
+	timer := time.NewTimer(searchTimeout)
+	defer timer.Stop()
+	response := stream.Reply
+	for {
+		if addr, ok := response["addr"].(string); ok {
+			version, label, key, ok := parseAddr(addr)
+			if ok {
+				keyIP, err := publicKeyToIP6(key)
+				path, perr := ParseLabel(label)
+				if err == nil && perr == nil && keyIP.String() == ip {
+					return Destination{IP: ip, PublicKey: key, Label: path, Version: int32(version)}, nil
+				}
+			}
+		}
+		if complete, _ := response["complete"].(int64); complete != 0 {
+			return Destination{}, fmt.Errorf("search for %s found nothing", ip)
+		}
+		select {
+		case msg, ok := <-stream.C:
+			if !ok {
+				select {
+				case <-cjdns.Admin.Done():
+					return Destination{}, ErrAdminClosed
+				default:
+					return Destination{}, ErrAdminDown
+				}
+			}
+			response = msg
+		case <-timer.C:
+			return Destination{}, fmt.Errorf("search for %s timed out", ip)
+		}
+	}
+}
+
+// parseAddr splits a cjdns address string v<version>.<label>.<pubkey>.k.
+func parseAddr(addr string) (int64, string, string, bool) {
+	parts := strings.Split(addr, ".")
+	if len(parts) != 7 || !strings.HasPrefix(parts[0], "v") {
+		return 0, "", "", false
+	}
+	version, err := strconv.ParseInt(parts[0][1:], 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return version, strings.Join(parts[1:5], "."), parts[5] + ".k", true
+}
+
+// publicKeyToIP6 derives a node's address, the first 16 bytes of the
+// double sha512 of its key, which must begin with fc.
+func publicKeyToIP6(pubkey string) (net.IP, error) {
+	keyBytes, err := Base32_decode(strings.TrimSuffix(pubkey, ".k"))
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != 32 {
+		return nil, fmt.Errorf("public key %s has %d bytes", pubkey, len(keyBytes))
+	}
+	first := sha512.Sum512(keyBytes)
+	second := sha512.Sum512(first[:])
+	if second[0] != 0xfc {
+		return nil, fmt.Errorf("public key %s does not map to an fc address", pubkey)
+	}
+	return net.IP(second[:16]), nil
+}
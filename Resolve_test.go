@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	testPubkey = "pvt7n9bt2s3jcl52glw1b06ruyg93y3qn4lfm9590ptjvxr90hj0.k"
+	testIP     = "fce3:86e9:b183:1a06:ad9a:c37f:14fe:36c2"
+)
+
+func TestPublicKeyToIP6(t *testing.T) {
+	ip, err := publicKeyToIP6(testPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != testIP {
+		t.Fatalf("publicKeyToIP6(%s) = %s, want %s", testPubkey, ip, testIP)
+	}
+}
+
+func TestResolveRejectsBadDestinations(t *testing.T) {
+	saved := cjdns.Admin
+	cjdns.Admin = nil
+	defer func() { cjdns.Admin = saved }()
+
+	tests := []struct {
+		name   string
+		ip     string
+		pubkey string
+		bad    bool
+	}{
+		{"unparsable", "not-an-address", "", true},
+		{"ipv4", "10.0.0.1", "", true},
+		{"not fc", "fd00::1", "", true},
+		{"bad key", "", "nonsense.k", true},
+		{"mismatched pair", "fc00::1", testPubkey, true},
+		{"matching pair", testIP, testPubkey, false},
+		{"uppercase matching pair", "FCE3:86E9:B183:1A06:AD9A:C37F:14FE:36C2", testPubkey, false},
+		{"key only", "", testPubkey, false},
+		{"fc address only", testIP, "", false},
+	}
+	for _, tt := range tests {
+		_, err := Resolve(tt.ip, tt.pubkey)
+		if err == nil {
+			t.Errorf("%s: Resolve(%q, %q) succeeded without a cjdns connection", tt.name, tt.ip, tt.pubkey)
+			continue
+		}
+		if got := errors.Is(err, ErrBadDestination); got != tt.bad {
+			t.Errorf("%s: Resolve(%q, %q) = %v, ErrBadDestination %v, want %v", tt.name, tt.ip, tt.pubkey, err, got, tt.bad)
+		}
+	}
+	if len(resolveCache) != 0 {
+		t.Errorf("resolve cache holds %v", resolveCache)
+	}
+}
+
+func TestResolveCacheBounded(t *testing.T) {
+	resolveMu.Lock()
+	saved := resolveCache
+	resolveCache = make(map[string]cachedDestination)
+	resolveMu.Unlock()
+	defer func() {
+		resolveMu.Lock()
+		resolveCache = saved
+		resolveMu.Unlock()
+	}()
+
+	resolveCache["fc00::dead"] = cachedDestination{expires: time.Now().Add(-time.Second)}
+	for i := 0; i < 2*resolveCacheMax; i++ {
+		cacheDestination(fmt.Sprintf("fc00::%x", i+1), Destination{})
+	}
+	if len(resolveCache) != resolveCacheMax {
+		t.Fatalf("cache holds %d entries, want at most %d", len(resolveCache), resolveCacheMax)
+	}
+	if _, ok := resolveCache["fc00::dead"]; ok {
+		t.Fatal("an expired entry was kept")
+	}
+	if _, ok := resolveCache[fmt.Sprintf("fc00::%x", 2*resolveCacheMax)]; !ok {
+		t.Fatal("the newest entry was evicted")
+	}
+
+	resolveCache[testIP] = cachedDestination{dest: testDest, expires: time.Now().Add(-time.Second)}
+	saveAdmin := cjdns.Admin
+	cjdns.Admin = nil
+	defer func() { cjdns.Admin = saveAdmin }()
+	if _, err := Resolve(testIP, testPubkey); err == nil {
+		t.Fatal("Resolve answered from an expired entry")
+	}
+	if _, ok := resolveCache[testIP]; ok {
+		t.Fatal("the expired entry was not removed on lookup")
+	}
+}
+
+func TestSearchInterruptedByReconnect(t *testing.T) {
+	first := newFakeCjdroute(t, "")
+	first.ignore = "SearchRunner_search"
+	second := newFakeCjdroute(t, "")
+	ac := newAdminClient(first, AdminConfig{}, func() (AdminTransport, error) { return second, nil })
+	saved := cjdns.Admin
+	cjdns.Admin = ac
+	defer func() { cjdns.Admin = saved }()
+	defer ac.Close()
+
+	// Subscribe only returns once answered, so answer it by hand.
+	done := make(chan error, 1)
+	go func() {
+		_, err := search(testIP)
+		done <- err
+	}()
+	txid := ""
+	for txid == "" {
+		time.Sleep(10 * time.Millisecond)
+		first.mu.Lock()
+		for _, request := range first.requests {
+			if request["q"] == "SearchRunner_search" {
+				txid, _ = request["txid"].(string)
+			}
+		}
+		first.mu.Unlock()
+	}
+	first.replies <- []byte("d4:txid" + fmt.Sprint(len(txid)) + ":" + txid + "e")
+	for answered := false; !answered; {
+		time.Sleep(time.Millisecond)
+		ac.mu.Lock()
+		_, waiting := ac.pending[txid]
+		_, streaming := ac.streams[txid]
+		answered = !waiting && streaming
+		ac.mu.Unlock()
+	}
+	first.Close()
+	if err := <-done; !errors.Is(err, ErrAdminDown) {
+		t.Fatalf("search during a reconnect = %v, want %v", err, ErrAdminDown)
+	}
+}
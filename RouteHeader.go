@@ -22,6 +22,10 @@ type RouteHeader struct {
 	SwitchHeader SwitchHeader
 	IsIncoming   bool
 	IsCtrl       bool
+	// Flags holds the flag bits other than F_CTRL and F_INCOMING, Pad the
+	// three bytes after them. Both are kept so frames re-encode as is.
+	Flags byte
+	Pad   [3]byte
 }
 
 func (rh *RouteHeader) serialize() ([]byte, error) {
@@ -39,14 +43,14 @@ func (rh *RouteHeader) serialize() ([]byte, error) {
 	versionBytes := make([]byte, 4)
 	version := uint32(rh.Version)
 	binary.BigEndian.PutUint32(versionBytes, version)
-	flags := byte(0)
+	flags := rh.Flags &^ (F_CTRL | F_INCOMING)
 	if rh.IsIncoming {
 		flags |= F_INCOMING
 	}
 	if rh.IsCtrl {
 		flags |= F_CTRL
 	}
-	padBytes := []byte{flags, 0, 0, 0}
+	padBytes := []byte{flags, rh.Pad[0], rh.Pad[1], rh.Pad[2]}
 	ipBytes := ZEROIP
 	// fmt.Println("serialize isCTRL:", rh.IsCtrl)
 	if string(rh.IP) != "" {
@@ -60,7 +64,7 @@ func (rh *RouteHeader) serialize() ([]byte, error) {
 func (rh *RouteHeader) parse(hdrBytes []byte) (RouteHeader, error) {
 	// fmt.Println("Parse hdrBytes:", hdrBytes)
 	if len(hdrBytes) < RouteHeaderSize {
-		return RouteHeader{}, errors.New("runt")
+		return RouteHeader{}, decodeErr("RouteHeader", ErrRunt, "%d bytes", len(hdrBytes))
 	}
 	x := 0
 	keyBytes := hdrBytes[x : x+32]
@@ -69,23 +73,16 @@ func (rh *RouteHeader) parse(hdrBytes []byte) (RouteHeader, error) {
 	x += 12
 	versionBytes := hdrBytes[x : x+4]
 	x += 4
-	flags := hdrBytes[x+1]
-
-	x += 2
-	// unusedBytes := hdrBytes[x : x+2]
-	// fmt.Println("unusedBytes", unusedBytes)
-	x += 2
+	flags := hdrBytes[x]
+	x++
+	var pad [3]byte
+	copy(pad[:], hdrBytes[x:x+3])
+	x += 3
 	ipBytes := hdrBytes[x : x+16]
-	isCtrl := false
-	if flags != 0 {
-		isCtrl = true
-	}
+	isCtrl := flags&F_CTRL != 0
 	// fmt.Println("parse isCtrl:", isCtrl)
-	if RouteHeaderSize != len(hdrBytes) {
-		return RouteHeader{}, errors.New("invalid header size")
-	}
 	if !isCtrl && isAllZero(ipBytes) {
-		return RouteHeader{}, errors.New("IP6 is not defined")
+		return RouteHeader{}, decodeErr("RouteHeader", ErrBadAddress, "IP6 is not defined")
 	}
 	// } else if isCtrl && !isAllZero(ipBytes) {
 	// 	// return RouteHeader_t{}, errors.New("IP6 is defined for CTRL frame")
@@ -93,14 +90,18 @@ func (rh *RouteHeader) parse(hdrBytes []byte) (RouteHeader, error) {
 	// }
 	switchHeader := SwitchHeader{}
 	switchHeader, err := switchHeader.parse(shBytes)
-
 	if err != nil {
-		switchHeader = SwitchHeader{}
-		fmt.Println(err)
+		return RouteHeader{}, err
 	}
 	var ip net.IP = nil
 	if !isCtrl {
-		ip = ip6_bytes_to_net_ip(ipBytes)
+		ip, err = ip6_bytes_to_net_ip(ipBytes)
+		if err != nil {
+			return RouteHeader{}, err
+		}
+	} else if !isAllZero(ipBytes) {
+		// Not an address to send to, but kept for re-encoding.
+		ip = net.IP(ipBytes)
 	}
 	out := RouteHeader{
 		PublicKey:    keyBytesToString(keyBytes),
@@ -109,6 +110,8 @@ func (rh *RouteHeader) parse(hdrBytes []byte) (RouteHeader, error) {
 		SwitchHeader: switchHeader,
 		IsIncoming:   flags&F_INCOMING != 0,
 		IsCtrl:       isCtrl,
+		Flags:        flags &^ (F_CTRL | F_INCOMING),
+		Pad:          pad,
 	}
 	// fmt.Println("hdrBytes", hdrBytes)
 	// fmt.Println("keyBytes", keyBytes)
@@ -142,27 +145,30 @@ func stringToKeyBytes(key string) []byte {
 func keyBytesToString(bytes []byte) string {
 	if len(bytes) != 32 {
 		fmt.Println("unexpected length", len(bytes))
+		return Base32_encode(bytes) + ".k"
 	}
-	return Base32_encode(bytes) + ".k"
+	return cachedKeyString(bytes)
 }
 
-func ip6_bytes_to_net_ip(ip6 []byte) net.IP {
+func ip6_bytes_to_net_ip(ip6 []byte) (net.IP, error) {
 	if len(ip6) != 16 {
-		panic("bad length")
+		return nil, decodeErr("IP6", ErrBadAddress, "%d bytes", len(ip6))
 	}
 	if ip6[0] != 0xfc {
-		panic("does not begin with fc")
+		return nil, decodeErr("IP6", ErrBadAddress, "%s does not begin with fc", net.IP(ip6))
 	}
-	return net.IP(ip6)
+	return net.IP(ip6), nil
 }
 
+const b32Chars = "0123456789bcdfghjklmnpqrstuvwxyz"
+
 func Base32_encode(input []byte) string {
-	B32_CHARS := []byte("0123456789bcdfghjklmnpqrstuvwxyz")
+	B32_CHARS := b32Chars
 	outIndex := 0
 	inIndex := 0
 	work := 0
 	bits := 0
-	var output []byte
+	output := make([]byte, 0, (len(input)*8+4)/5)
 	for inIndex < len(input) {
 		work |= int(input[inIndex]) << bits
 		bits += 8
@@ -210,7 +216,7 @@ func Base32_decode(input string) ([]byte, error) {
 		b := NUM_FOR_ASCII[o]
 		inputIndex++
 		if b > 31 {
-			return nil, errors.New("bad character " + string(input[inputIndex]) + " in " + input)
+			return nil, errors.New("bad character " + string(rune(o)) + " in " + input)
 		}
 
 		nextByte |= (b << bits)
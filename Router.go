@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Registering a range registers one UpperDistributor handler per content
+// type, so ranges are capped.
+const maxRouteRange = 256
+
+// MessageHandler is called with every inbound message a route accepts.
+type MessageHandler func(*Message)
+
+// ViewHandler is called with a view over the receive buffer, which is
+// reused once the handler returns.
+type ViewHandler func(MessageView)
+
+type route struct {
+	lo, hi  int64
+	q       string
+	handler MessageHandler
+	view    ViewHandler
+}
+
+func (rt *route) covers(contentType int64) bool {
+	return contentType >= rt.lo && contentType <= rt.hi
+}
+
+func (rt *route) matches(contentType int64, message *Message) bool {
+	if rt.handler == nil || !rt.covers(contentType) {
+		return false
+	}
+	if rt.q == "" {
+		return true
+	}
+	benc, ok := message.ContentBenc.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	q, _ := benc["q"].(string)
+	return q == rt.q
+}
+
+// Router reads UpperDistributor traffic from one UDP port and dispatches
+// each message to every route registered for its content type. Adding a
+// route registers the matching UpperDistributor handler.
+type Router struct {
+	conn *net.UDPConn
+	port int64
+
+	mu         sync.RWMutex
+	routes     []route
+	registered map[int64]bool
+}
+
+// NewRouter binds an OS-chosen UDP port on localIP.
+func NewRouter(localIP string) (*Router, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(localIP), Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	return &Router{
+		conn:       conn,
+		port:       int64(conn.LocalAddr().(*net.UDPAddr).Port),
+		registered: make(map[int64]bool),
+	}, nil
+}
+
+// Handle routes messages of contentType, such as ContentType_CJDHT,
+// ContentType_IPTUN or ContentType_CTRL, to fn.
+func (r *Router) Handle(contentType int64, fn MessageHandler) error {
+	return r.add(route{lo: contentType, hi: contentType, handler: fn})
+}
+
+// HandleView routes messages of contentType to fn without decoding them.
+// Fragments of RESERVED payloads are passed on one datagram at a time.
+func (r *Router) HandleView(contentType int64, fn ViewHandler) error {
+	return r.add(route{lo: contentType, hi: contentType, view: fn})
+}
+
+// HandleQuery routes bencoded messages of contentType whose "q" is q to fn.
+func (r *Router) HandleQuery(contentType int64, q string, fn MessageHandler) error {
+	return r.add(route{lo: contentType, hi: contentType, q: q, handler: fn})
+}
+
+// HandleRange routes every content type from lo to hi inclusive to fn,
+// for example a slice of the ContentType_AVAILABLE space. cjdroute has no
+// wildcard handler, each type in the range is registered on its own, so a
+// range holds at most maxRouteRange types and the whole AVAILABLE space
+// (0x8000-0xffff) cannot be routed at once.
+func (r *Router) HandleRange(lo int64, hi int64, fn MessageHandler) error {
+	if hi < lo || hi-lo >= maxRouteRange {
+		return fmt.Errorf("content type range %d-%d must hold 1 to %d types", lo, hi, maxRouteRange)
+	}
+	return r.add(route{lo: lo, hi: hi, handler: fn})
+}
+
+func (r *Router) add(rt route) error {
+	if rt.lo < 0 || rt.hi >= ContentType_MAX {
+		return fmt.Errorf("content type range %d-%d out of bounds", rt.lo, rt.hi)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var added []int64
+	for contentType := rt.lo; contentType <= rt.hi; contentType++ {
+		if r.registered[contentType] {
+			continue
+		}
+		if err := registerHandler(contentType, r.port); err != nil {
+			// No route is added, so neither are the handlers before it.
+			for _, contentType := range added {
+				if uerr := unregisterHandler(contentType, r.port); uerr != nil {
+					fmt.Println("Error unregistering handler", contentType, ":", uerr)
+				}
+				delete(r.registered, contentType)
+			}
+			return err
+		}
+		r.registered[contentType] = true
+		added = append(added, contentType)
+	}
+	r.routes = append(r.routes, rt)
+	return nil
+}
+
+// Serve reads and dispatches messages until the router is closed.
+func (r *Router) Serve() error {
+	reassembler := NewReassembler()
+	for {
+		// The buffer goes back to the pool once receive returns, view
+		// handlers are done with it and decoded messages hold copies.
+		buf := getPacketBuf()
+		n, _, err := r.conn.ReadFromUDP(*buf)
+		if err != nil {
+			putPacketBuf(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			fmt.Printf("Error reading from UDP port %d: %v\n", r.port, err)
+			continue
+		}
+		r.receive((*buf)[:n], reassembler)
+		putPacketBuf(buf)
+	}
+}
+
+// receive hands packet to the view routes for its content type, and only
+// decodes a copy of it if some other route wants it.
+func (r *Router) receive(packet []byte, reassembler *Reassembler) {
+	view, err := ViewMessage(packet)
+	if err != nil {
+		fmt.Println("Dropping message:", err)
+		return
+	}
+	contentType := view.ContentType()
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+	handled, decode := false, false
+	for i := range routes {
+		if !routes[i].covers(contentType) {
+			continue
+		}
+		if routes[i].view != nil {
+			routes[i].view(view)
+			handled = true
+		} else {
+			decode = true
+		}
+	}
+	if decode {
+		message, err := view.Decode()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if message, complete := reassembler.Add(message); complete {
+			r.dispatch(&message, routes)
+		}
+		return
+	}
+	if !handled {
+		fmt.Println("No route for content type", contentType)
+	}
+}
+
+func (r *Router) dispatch(message *Message, routes []route) {
+	contentType := messageContentType(message)
+	handled := false
+	for i := range routes {
+		if routes[i].matches(contentType, message) {
+			routes[i].handler(message)
+			handled = true
+		}
+	}
+	if !handled {
+		fmt.Println("No route for content type", contentType)
+	}
+}
+
+// Close unregisters every content type registered on the router's port
+// and stops Serve.
+func (r *Router) Close() error {
+	var err error
+	r.mu.Lock()
+	for contentType := range r.registered {
+		if uerr := unregisterHandler(contentType, r.port); err == nil {
+			err = uerr
+		}
+		delete(r.registered, contentType)
+	}
+	r.mu.Unlock()
+	if cerr := r.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// messageContentType is the UpperDistributor content type of message,
+// CTRL frames have no data header.
+func messageContentType(message *Message) int64 {
+	if message.RouteHeader.IsCtrl {
+		return ContentType_CTRL
+	}
+	return int64(message.DataHeader.ContentType)
+}
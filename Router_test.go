@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+)
+
+func testRouterPackets(t *testing.T) map[string][]byte {
+	peer := benchDestination()
+	packets := make(map[string][]byte)
+	for _, q := range []string{"invoice_req", "other"} {
+		payloads, err := createReservedMessages(peer, map[string]interface{}{"q": q, "txid": "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets[q] = payloads[0]
+	}
+	cjdht, err := createCjdhtMessage(peer, NewCjdhtQuery(CJDHT_GET_PEERS, LabelTarget(0x13)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets["cjdht"] = cjdht
+	for name, contentType := range map[string]uint16{"available": ContentType_AVAILABLE + 1, "unrouted": ContentType_AVAILABLE + 0x100} {
+		message := Message{
+			RouteHeader:  RouteHeader{PublicKey: peer.PublicKey, IP: net.ParseIP(peer.IP), SwitchHeader: SwitchHeader{Label: peer.Label, Version: 1}},
+			DataHeader:   DataHeader{ContentType: contentType, Version: 1},
+			ContentBytes: []byte("opaque"),
+		}
+		if packets[name], err = message.encode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctrl, err := (&CtrlMsg{Type: CTRL_PING, Ping: &CtrlPing{Version: switchPingVersion, Data: []byte("01234567")}}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := Message{RouteHeader: RouteHeader{SwitchHeader: SwitchHeader{Label: 0x13, Version: currentVer}, IsCtrl: true}, ContentBytes: ctrl}
+	if packets["ctrl"], err = message.encode(); err != nil {
+		t.Fatal(err)
+	}
+	return packets
+}
+
+func TestRouterDispatch(t *testing.T) {
+	fake := useFakeRegistry(t, nil)
+	r, err := NewRouter("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var fired []string
+	handler := func(name string) MessageHandler {
+		return func(*Message) { fired = append(fired, name) }
+	}
+	for _, err := range []error{
+		r.HandleQuery(ContentType_RESERVED, "invoice_req", handler("invoice_req")),
+		r.Handle(ContentType_RESERVED, handler("reserved")),
+		r.HandleRange(ContentType_AVAILABLE, ContentType_AVAILABLE+maxRouteRange-1, handler("range")),
+		r.Handle(ContentType_CTRL, func(m *Message) {
+			if ctrl, ok := m.Content.(*CtrlMsg); ok && ctrl.Type == CTRL_PING {
+				fired = append(fired, "ctrl")
+			}
+		}),
+		r.HandleView(ContentType_CJDHT, func(MessageView) { fired = append(fired, "cjdht view") }),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.mu.Lock()
+	if n := len(fake.handlers); n != maxRouteRange+3 {
+		t.Errorf("%d handlers registered, want one per content type, %d", n, maxRouteRange+3)
+	}
+	fake.mu.Unlock()
+
+	tests := []struct {
+		packet string
+		fired  []string
+	}{
+		{"invoice_req", []string{"invoice_req", "reserved"}},
+		{"other", []string{"reserved"}},
+		{"available", []string{"range"}},
+		{"unrouted", nil},
+		{"ctrl", []string{"ctrl"}},
+		{"cjdht", []string{"cjdht view"}},
+	}
+	packets := testRouterPackets(t)
+	reassembler := NewReassembler()
+	for _, tt := range tests {
+		fired = nil
+		r.receive(packets[tt.packet], reassembler)
+		sort.Strings(fired)
+		if fmt.Sprint(fired) != fmt.Sprint(tt.fired) {
+			t.Errorf("%s packet reached %v, want %v", tt.packet, fired, tt.fired)
+		}
+	}
+}
+
+func TestRouterRegistration(t *testing.T) {
+	fake := useFakeRegistry(t, nil)
+	fake.maxHandlers = 5
+	r, err := NewRouter("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.HandleRange(ContentType_AVAILABLE, ContentType_AVAILABLE+maxRouteRange, func(*Message) {}); err == nil {
+		t.Error("HandleRange accepted more than maxRouteRange types")
+	}
+	if err := r.Handle(-1, func(*Message) {}); err == nil {
+		t.Error("Handle accepted a negative content type")
+	}
+	if err := r.HandleRange(ContentType_AVAILABLE, ContentType_AVAILABLE+9, func(*Message) {}); err == nil {
+		t.Fatal("HandleRange succeeded past the handler limit")
+	}
+	fake.mu.Lock()
+	left := len(fake.handlers)
+	fake.mu.Unlock()
+	if left != 0 || len(r.registered) != 0 || len(r.routes) != 0 || len(handlers.snapshot()) != 0 {
+		t.Fatalf("failed range left %d handlers in cjdroute, %d registered, %d routes", left, len(r.registered), len(r.routes))
+	}
+
+	if err := r.Handle(ContentType_RESERVED, func(*Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.HandleQuery(ContentType_RESERVED, "invoice_req", func(*Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Handle(ContentType_CJDHT, func(*Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	registered := len(fake.handlers)
+	fake.mu.Unlock()
+	if registered != 2 {
+		t.Fatalf("%d handlers registered for two content types", registered)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	left = len(fake.handlers)
+	fake.mu.Unlock()
+	if left != 0 || len(handlers.snapshot()) != 0 {
+		t.Fatalf("Close left %d handlers in cjdroute", left)
+	}
+}
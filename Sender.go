@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// cjdns picks up datagrams sent to this address through the tun device
+	// and hands them to the UpperDistributor.
+	upperDistributorAddr = "[fc00::1]:1"
+	maxDatagramSize      = 65535
+)
+
+var ErrSenderClosed = errors.New("sender closed")
+
+type senderWaiter struct {
+	match func(*Message) bool
+	ch    chan Message
+}
+
+// Sender owns one UDP socket bound to an OS-chosen port on the tun
+// address, registered once with the UpperDistributor. Sends from any
+// goroutine share it, and inbound messages are handed to the waiter whose
+// match function accepts them.
+type Sender struct {
+	conn        *net.UDPConn
+	rAddr       *net.UDPAddr
+	contentType int64
+	port        int64
+
+	mu      sync.Mutex
+	waiters []*senderWaiter
+	done    map[string]time.Time
+	closed  bool
+}
+
+func NewSender(device string, contentType int64) (*Sender, error) {
+	rAddr, err := net.ResolveUDPAddr("udp", upperDistributorAddr)
+	if err != nil {
+		return nil, err
+	}
+	ipv6, err := getDeviceAddr(device)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ipv6), Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	port := int64(conn.LocalAddr().(*net.UDPAddr).Port)
+	err = registerHandler(contentType, port)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &Sender{conn: conn, rAddr: rAddr, contentType: contentType, port: port}
+	go s.readLoop()
+	return s, nil
+}
+
+// Send writes an encoded Message to cjdns.
+func (s *Sender) Send(payload []byte) error {
+	_, err := s.conn.WriteToUDP(payload, s.rAddr)
+	return err
+}
+
+// Expect registers interest in the next inbound message that match
+// accepts. The returned cancel func must be called if the caller stops
+// waiting before a message arrives.
+func (s *Sender) Expect(match func(*Message) bool) (<-chan Message, func()) {
+	w := &senderWaiter{match: match, ch: make(chan Message, 1)}
+	s.mu.Lock()
+	if s.closed {
+		close(w.ch)
+	} else {
+		s.waiters = append(s.waiters, w)
+	}
+	s.mu.Unlock()
+	return w.ch, func() { s.removeWaiter(w) }
+}
+
+func (s *Sender) removeWaiter(w *senderWaiter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.waiters {
+		if other == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Sender) readLoop() {
+	reassembler := NewReassembler()
+	for {
+		buf := getPacketBuf()
+		n, _, err := s.conn.ReadFromUDP(*buf)
+		if err != nil {
+			putPacketBuf(buf)
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Println("Error reading from sender port", s.port, ":", err)
+			}
+			s.closeWaiters()
+			return
+		}
+		message, err := decode(append([]byte(nil), (*buf)[:n]...))
+		putPacketBuf(buf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		message, complete := reassembler.Add(message)
+		if !complete {
+			continue
+		}
+		if !s.deliver(&message) && !s.isDuplicate(&message) {
+			fmt.Println("Dropping unexpected message on sender port", s.port)
+		}
+	}
+}
+
+func (s *Sender) deliver(message *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiters {
+		if w.match(message) {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			w.ch <- *message
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Sender) closeWaiters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, w := range s.waiters {
+		close(w.ch)
+	}
+	s.waiters = nil
+}
+
+// Close unregisters the handler and closes the socket.
+func (s *Sender) Close() error {
+	err := unregisterHandler(s.contentType, s.port)
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var (
+	senderMu sync.Mutex
+	senders  = make(map[int64]*Sender)
+)
+
+// getSender returns the process wide sender for contentType, creating it
+// on first use.
+func getSender(contentType int64) (*Sender, error) {
+	senderMu.Lock()
+	defer senderMu.Unlock()
+	if s, ok := senders[contentType]; ok {
+		return s, nil
+	}
+	s, err := NewSender(cjdns.Device, contentType)
+	if err != nil {
+		return nil, err
+	}
+	senders[contentType] = s
+	return s, nil
+}
@@ -1,12 +1,8 @@
 package main
 
 import (
-	"encoding/hex"
-	"errors"
-	"strings"
-
+	"encoding/binary"
 	// "fmt"
-	"regexp"
 )
 
 const (
@@ -15,7 +11,7 @@ const (
 )
 
 type SwitchHeader struct {
-	Label         string
+	Label         Label
 	Congestion    int
 	SuppressError bool
 	Version       int
@@ -26,15 +22,15 @@ type SwitchHeader struct {
 func (sh *SwitchHeader) parse(hdrBytes []byte) (SwitchHeader, error) {
 	// fmt.Println("Parse switch header", hdrBytes)
 	if len(hdrBytes) < SwitchHeaderSize {
-		return SwitchHeader{}, errors.New("runt")
+		return SwitchHeader{}, decodeErr("SwitchHeader", ErrRunt, "%d bytes", len(hdrBytes))
 	}
 	x := 0
 	labelBytes := hdrBytes[x : x+8]
 	x += 8
 	congestAndSuppressErrors := hdrBytes[x]
-	x += 2
+	x++
 	versionAndLabelShift := hdrBytes[x]
-	x += 2
+	x++
 
 	version := versionAndLabelShift >> 6
 
@@ -43,27 +39,24 @@ func (sh *SwitchHeader) parse(hdrBytes []byte) (SwitchHeader, error) {
 	} else if version != currentVer {
 		// fmt.Println("WARNING: Parsing label with unrecognized version number [", version, "]")
 	}
-	labelStr := hex.EncodeToString(labelBytes)
-	//labelRegex       = "^([a-f0-9]{4}\\.){3}[a-f0-9]{4}$"
-	re := regexp.MustCompile(`[0-9a-f]{4}`)
-	labelStr = re.ReplaceAllString(labelStr, "$0.")
-	labelStr = labelStr[:len(labelStr)-1]
 	return SwitchHeader{
-		Label:         labelStr,
+		Label:         Label(binary.BigEndian.Uint64(labelBytes)),
 		Congestion:    int(congestAndSuppressErrors >> 1),
 		SuppressError: congestAndSuppressErrors&1 != 0,
 		Version:       int(version),
 		LabelShift:    int(versionAndLabelShift & ((1 << 6) - 1)),
-		Penalty:       int(hdrBytes[x-2])<<8 | int(hdrBytes[x-1]),
+		Penalty:       int(binary.BigEndian.Uint16(hdrBytes[x:])),
 	}, nil
 }
 
 func (sh *SwitchHeader) serialize() []byte {
     hdrBytes := make([]byte, SwitchHeaderSize)
-    labelBytes, _ := hex.DecodeString(strings.ReplaceAll(sh.Label, ".", "") + "00000000")
-    copy(hdrBytes[0:8], labelBytes)
-    hdrBytes[8] = byte(sh.Congestion<<1) | byte(0)
-    hdrBytes[9] = byte(sh.Version<<6) | byte(sh.LabelShift)
+    binary.BigEndian.PutUint64(hdrBytes[0:8], uint64(sh.Label))
+    hdrBytes[8] = byte(sh.Congestion&0x7f) << 1
+    if sh.SuppressError {
+        hdrBytes[8] |= 1
+    }
+    hdrBytes[9] = byte(sh.Version&3)<<6 | byte(sh.LabelShift&0x3f)
     hdrBytes[10] = byte(sh.Penalty >> 8)
     hdrBytes[11] = byte(sh.Penalty)
     return hdrBytes
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	switchPingTimeout = 5 * time.Second
+	switchPingVersion = defaultRouteVersion
+)
+
+// SwitchPong is the answer to a switch level PING or KEYPING.
+type SwitchPong struct {
+	Label   Label
+	Version uint32
+	Key     string // set for KEYPONG
+	RTT     time.Duration
+}
+
+// SwitchPing sends a PING, or a KEYPING when keyPing is set, control frame
+// down label through the UpperDistributor and waits for the matching PONG.
+func SwitchPing(label Label, keyPing bool, timeout time.Duration) (SwitchPong, error) {
+	if !label.Valid() {
+		return SwitchPong{}, errors.New("cannot ping label 0")
+	}
+	sender, err := getSender(ContentType_CTRL)
+	if err != nil {
+		return SwitchPong{}, err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return SwitchPong{}, err
+	}
+	ctrl := &CtrlMsg{Type: CTRL_PING, Ping: &CtrlPing{Version: switchPingVersion, Data: nonce}}
+	replyType := uint16(CTRL_PONG)
+	if keyPing {
+		key, err := ownPublicKey()
+		if err != nil {
+			return SwitchPong{}, err
+		}
+		ctrl.Type = CTRL_KEYPING
+		ctrl.Ping.Key = key
+		replyType = CTRL_KEYPONG
+	}
+	content, err := ctrl.encode()
+	if err != nil {
+		return SwitchPong{}, err
+	}
+	message := Message{
+		RouteHeader: RouteHeader{
+			SwitchHeader: SwitchHeader{
+				Label:   label,
+				Version: currentVer,
+			},
+			IsCtrl: true,
+		},
+		ContentBytes: content,
+	}
+	payload, err := message.encode()
+	if err != nil {
+		return SwitchPong{}, err
+	}
+
+	replies, cancel := sender.Expect(func(m *Message) bool {
+		pong, ok := m.Content.(*CtrlMsg)
+		return ok && pong.Type == replyType && pong.Ping != nil && bytes.Equal(pong.Ping.Data, nonce)
+	})
+	defer cancel()
+	start := time.Now()
+	if err := sender.Send(payload); err != nil {
+		return SwitchPong{}, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return SwitchPong{}, ErrSenderClosed
+		}
+		pong := reply.Content.(*CtrlMsg).Ping
+		return SwitchPong{
+			Label:   reply.RouteHeader.SwitchHeader.Label,
+			Version: pong.Version,
+			Key:     pong.Key,
+			RTT:     time.Since(start),
+		}, nil
+	case <-timer.C:
+		return SwitchPong{}, fmt.Errorf("no %s from %s", ctrlTypeString(replyType), label)
+	}
+}
+
+// ownPublicKey asks cjdns for this node's key, KEYPING carries it.
+func ownPublicKey() (string, error) {
+	if cjdns.Admin == nil {
+		return "", errors.New("CJDNS connection is nil")
+	}
+	response, err := cjdns.Admin.Call("Core_nodeInfo", nil)
+	if err != nil {
+		return "", err
+	}
+	myAddr, _ := response["myAddr"].(string)
+	_, _, key, ok := parseAddr(myAddr)
+	if !ok {
+		return "", errors.New("Core_nodeInfo returned no address")
+	}
+	return key, nil
+}
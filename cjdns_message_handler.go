@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
-
-	"github.com/zeebo/bencode"
 )
 
 const (
@@ -31,6 +34,7 @@ const (
 	ContentType_IP6_GRE      = 47
 	ContentType_IP6_ESP      = 50
 	ContentType_IP6_AH       = 51
+	ContentType_IP6_ICMP6    = 58
 	ContentType_IP6_MTP      = 92
 	ContentType_IP6_BEETPH   = 94
 	ContentType_IP6_ENCAP    = 98
@@ -48,93 +52,63 @@ const (
 	ContentType_MAX          = 0xffff + 2
 )
 
+const invoiceReplyTimeout = 30 * time.Second
+
 type Cjdns struct {
-	SocketPath string
-	Socket     net.Conn
-	Device     string
-	IPv6       string
+	SocketPath   string
+	Password     string
+	MaxReplySize int    // largest admin reply accepted in bytes, 0 means 1 MiB
+	HandlerState string // file recording our handler registrations
+	Admin        *AdminClient `json:"-"`
+	Device       string
+	IPv6         string
+	DecodeIP6    bool // have decode parse IP6 content types into gopacket layers
 }
 
 var cjdns Cjdns
 
-// Connect to CJDNS socket
+// Connect to CJDNS admin interface, SocketPath is either a unix socket
+// path, unix:///path or udp://host:port
 func Init() error {
-	conn, err := net.Dial("unix", cjdns.SocketPath)
-	if err != nil {
-		return err
-	}
-	cjdns.Socket = conn
-	return nil
-}
-
-// Close CJDNS socket
-func Close(ls net.Conn) error {
-	err := ls.Close()
+	admin, err := DialAdminClient(cjdns.SocketPath, AdminConfig{
+		MaxReplySize: cjdns.MaxReplySize,
+		Password:     cjdns.Password,
+		OnReconnect:  handlers.replay,
+		Events: func(ev AdminEvent) {
+			fmt.Println(ev)
+		},
+	})
 	if err != nil {
 		return err
 	}
+	cjdns.Admin = admin
 	return nil
 }
 
-func pingListener() (string, error) {
-	cjdns.Socket.SetReadDeadline(time.Now().Add(1 * time.Second))
-	buf := make([]byte, 1024)
-	n, err := cjdns.Socket.Read(buf)
-
-	var response map[string]interface{}
-	if n > 0 {
-		err := bencode.DecodeBytes(buf, &response)
-		if err != nil {
-			return "", err
-		}
-		// check if response has "addr" and "ms" fields
-		if addr, ok := response["addr"].(string); ok {
-			res := addr + " ms:" + fmt.Sprintf("%d", response["ms"].(int64))
-			return res, nil
-		} else if q, ok := response["q"].(string); ok && q == "pong" {
-			return q, nil
-		}
-		return "", nil
-	}
-	if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
-		return "", errors.New("CJDNS connection timeout")
-	} else if err != nil {
-		return "", err
-	}
-	return "", nil
-}
-
 func registerHandler(contentType int64, udpPort int64) error {
-	message := map[string]interface{}{
-		"q":    "UpperDistributor_registerHandler",
-		"args": map[string]int64{"contentType": contentType, "udpPort": udpPort},
-	}
-	fmt.Println("Message:", message)
-	bytes, err := bencode.EncodeBytes(message)
-	if err != nil {
-		return err
+	if cjdns.Admin == nil {
+		return errors.New("CJDNS connection is nil")
 	}
-	_, err = cjdns.Socket.Write(bytes)
+	args := map[string]interface{}{"contentType": contentType, "udpPort": udpPort}
+	fmt.Println("Register handler:", args)
+	_, err := cjdns.Admin.Call("UpperDistributor_registerHandler", args)
 	if err != nil {
 		return err
 	}
+	handlers.add(contentType, udpPort)
 	return nil
 }
 
-func unregisterHandler(udpPort int64) error {
-	message := map[string]interface{}{
-		"q":    "UpperDistributor_unregisterHandler",
-		"args": map[string]int64{"udpPort": udpPort},
+// unregisterHandler removes one registration on udpPort, cjdroute drops
+// the first handler it finds for the port on each call.
+func unregisterHandler(contentType int64, udpPort int64) error {
+	if cjdns.Admin == nil {
+		return errors.New("CJDNS connection is nil")
 	}
-	bytes, err := bencode.EncodeBytes(message)
-	if err != nil {
-		return err
-	}
-	_, err = cjdns.Socket.Write(bytes)
-	if err != nil {
-		return err
-	}
-	return nil
+	args := map[string]interface{}{"udpPort": udpPort}
+	_, err := cjdns.Admin.Call("UpperDistributor_unregisterHandler", args)
+	handlers.remove(contentType, udpPort)
+	return err
 }
 
 func getDeviceAddr(device string) (string, error) {
@@ -172,183 +146,121 @@ func getDeviceAddr(device string) (string, error) {
 
 func sendCjdnsMessage(cjdns_addr string, pubkey string, amount int) error {
 	fmt.Println("Send Cjdns message to:", cjdns_addr, "pubkey:", pubkey, "amount:", amount)
-	// use this to send a packet to cjdns throught tun0
-	rAddr, err := net.ResolveUDPAddr("udp", "[fc00::1]:1")
+	sender, err := getSender(ContentType_RESERVED)
 	if err != nil {
-		fmt.Println("Error resolving UDP address:", err)
+		fmt.Println("Error opening sender:", err)
 		return err
 	}
-	cjdns.IPv6, err = getDeviceAddr(cjdns.Device)
-	if err != nil {
-		fmt.Println("Error getting device address:", err)
-		return err
-	}
-	//bind to local address (tun0) and a port, then register that port to cjdns
-	sAddr := &net.UDPAddr{IP: net.ParseIP(cjdns.IPv6), Port: 37193}
-	conn, err := net.DialUDP("udp", sAddr, rAddr)
-	
-	registerHandler(ContentType_RESERVED, 37193)
-	if err != nil {
-		fmt.Println("Error dialing UDP address:", err)
-		return err
-	}
-	defer conn.Close()
 
 	// Data to send
 	// receiverPubkey := "pvt7n9bt2s3jcl52glw1b06ruyg93y3qn4lfm9590ptjvxr90hj0.k"
 	// receiverIP := "fce3:86e9:b183:1a06:ad9a:c37f:14fe:36c2"
-	data := createInvoiceRequest(cjdns_addr, pubkey, amount)
-	// Send data
-	_, err = conn.Write(data)
+	dest, err := Resolve(cjdns_addr, pubkey)
+	if errors.Is(err, ErrBadDestination) {
+		return err
+	}
 	if err != nil {
-		fmt.Println("Error sending UDP packet:", err)
-		unregisterHandler(37193)
+		fmt.Println("Error resolving destination, letting cjdns look it up:", err)
+		dest = Destination{IP: cjdns_addr, PublicKey: pubkey, Label: defaultRouteLabel, Version: defaultRouteVersion}
+		if dest.IP == "" {
+			ip, err := publicKeyToIP6(pubkey)
+			if err != nil {
+				return err
+			}
+			dest.IP = ip.String()
+		}
+	}
+	fmt.Println("Resolved destination:", dest)
+	msg := createInvoiceRequest(amount)
+	fmt.Println("Bencode content:", msg)
+	ctx, cancel := context.WithTimeout(context.Background(), invoiceReplyTimeout)
+	defer cancel()
+	reply, err := sender.Request(ctx, dest, msg)
+	if err != nil {
+		fmt.Println("Error sending invoice request:", err)
 		return err
 	}
 
-	fmt.Println("UDP packet sent successfully")
-	unregisterHandler(37193)
+	fmt.Println("Received reply:", reply.ContentBenc)
 	return nil
 }
 
 func ListeningForInvoiceRequest(cjdnsaddr string) error {
 	// use this to read a packet to cjdns throught tun0
 	cjdns.IPv6, _ = getDeviceAddr(cjdns.Device)
-	rAddr, err := net.ResolveUDPAddr("udp", "["+cjdnsaddr+"]:0")
-	fmt.Println("ListeningForInvoiceRequest:", rAddr)
+	fmt.Println("ListeningForInvoiceRequest:", cjdnsaddr)
+
+	//bind to local address (tun0) and a port, the router registers that port to cjdns
+	router, err := NewRouter(cjdnsaddr)
 	if err != nil {
-		fmt.Println("Error resolving UDP address:", err)
+		fmt.Println("Error dialing UDP address:", err)
 		return err
 	}
-
-	//bind to local address (tun0) and a port, then register that port to cjdns
-	fmt.Println("Port:", rAddr.Port)
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(cjdnsaddr), Port: rAddr.Port})
+	fmt.Println("Port:", router.port)
+	err = router.Handle(ContentType_RESERVED, func(message *Message) {
+		fmt.Println("Received RESERVED message")
+	})
 	if err != nil {
-		fmt.Println("Error dialing UDP address:", err)
 		return err
 	}
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	registerHandler(ContentType_RESERVED, int64(localAddr.Port))
-	buf := make([]byte, 1024)
-	// go func() {
-		for {
-			n, addr, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				fmt.Printf("Error reading from UDP port %d: %v\n", rAddr.Port, err)
-				continue
-			}
-			fmt.Printf("Received %d bytes from %s: %s\n", n, addr.String(), string(buf[:n]))
-			message, err := decode(buf[:n])
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			if message.DataHeader.ContentType == ContentType_RESERVED {
-				fmt.Println("Received RESERVED message")
-
-				if message.ContentBenc.(map[string]interface{})["q"] != nil && message.ContentBenc.(map[string]interface{})["q"].(string) == "invoice_req" {
-					fmt.Println("Received request")
-					// Decode request
-
-				}
-			}
-		}
-	// }()
-	//unregisterHandler(int64(localAddr.Port))
-	// return nil
+	err = router.HandleQuery(ContentType_RESERVED, "invoice_req", func(message *Message) {
+		fmt.Println("Received request")
+		// Decode request
+	})
+	if err != nil {
+		return err
+	}
+	return router.Serve()
 }
 
-
+// generateRandomNumber returns a 10 digit number from crypto/rand, txids
+// are made from it and must not be guessable by other nodes.
 func generateRandomNumber() int {
-    rand.Seed(time.Now().UnixNano())
-    return rand.Intn(9000000000) + 1000000000
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return int(binary.BigEndian.Uint64(b[:])%9000000000) + 1000000000
 }
 
-func createInvoiceRequest(receiverIP string, receiverPubkey string, amount int) []byte {
+func createInvoiceRequest(amount int) map[string]interface{} {
 	// Set the application layer payload
-	coinType := []byte{0x80, 0x00, 0x01, 0x86}
-	var bytesMessage []byte = nil
 	txid := generateRandomNumber()
-	msg := map[string]interface{}{
+	return map[string]interface{}{
 		"q":    "invoice_req",
 		"amt":  amount,
 		"txid": strconv.Itoa(txid)+"/0",
 	}
-
-	bytesMessage = append(bytesMessage, coinType...)
-	encodedMsg, err := bencode.EncodeBytes(msg)
-	if err != nil {
-		fmt.Println("Error encoding message:", err)
-	}
-	bytesMessage = append(bytesMessage, encodedMsg...)
-	var cjdnsip net.IP = net.ParseIP(receiverIP)
-	var message Message = Message{
-		RouteHeader: RouteHeader{
-			PublicKey: receiverPubkey,
-			Version:   22,
-			IP:        cjdnsip,
-			SwitchHeader: SwitchHeader{
-				Label:   "0000",
-				Version: 1,
-			},
-			IsIncoming: false,
-			IsCtrl:     false,
-		},
-		DataHeader: DataHeader{
-			ContentType: ContentType_RESERVED,
-			Version:     1,
-		},
-		ContentBytes: bytesMessage,
-		RawBytes:     nil,
-		ContentBenc:  msg,
-		Content:      nil,
-	}
-	fmt.Println("Bencode content:", msg)
-	payload, err := message.encode()
-	if err != nil {
-		fmt.Println("Error encoding message:", err)
-	}
-	return payload
 }
 
 func ping(node string) (string, error) {
 	fmt.Println("Ping Cjdns node:", node)
-	err := error(nil)
-	if cjdns.Socket == nil {
+	if cjdns.Admin == nil {
 		return "", errors.New("CJDNS connection is nil")
 	}
 
-	ping := map[string]string{
-		"q": "ping",
-	}
-	pingNode := map[string]interface{}{
-		"q":    "RouterModule_pingNode",
-		"args": map[string]string{"path": "fc93:1145:f24c:ee59:4a09:288e:ada8:0901"},
-	}
-	var bytes []byte
-	if node != "" {
-		bytes, err = bencode.EncodeBytes(pingNode)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		bytes, err = bencode.EncodeBytes(ping)
+	if node == "" {
+		response, err := cjdns.Admin.Call("ping", nil)
 		if err != nil {
 			return "", err
 		}
+		q, _ := response["q"].(string)
+		return q, nil
 	}
 
-	_, err = cjdns.Socket.Write(bytes)
+	response, err := cjdns.Admin.Call("RouterModule_pingNode", map[string]interface{}{"path": node})
 	if err != nil {
 		return "", err
 	}
-	data, err := pingListener()
-	if err != nil {
-		return "", err
+	// check if response has "addr" and "ms" fields
+	if addr, ok := response["addr"].(string); ok {
+		ms, _ := response["ms"].(int64)
+		return addr + " ms:" + fmt.Sprintf("%d", ms), nil
 	}
-
-	return data, nil
+	if result, ok := response["result"].(string); ok {
+		return result, nil
+	}
+	return "", nil
 }
 
 func readConfig() {
@@ -377,25 +289,67 @@ func main() {
 		fmt.Println(err)
 	}
 
+	stateFile := cjdns.HandlerState
+	if stateFile == "" {
+		stateFile = defaultHandlerStateFile
+	}
+	err = handlers.reconcile(stateFile)
+	if err != nil {
+		fmt.Println("Error reconciling handlers:", err)
+	}
+	// SIGINT and SIGTERM only cancel ctx, whatever runs cleans up on that
+	// before the process goes away.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
 	var udpPort int64 = 1
 	registerHandler(ContentType_RESERVED, udpPort)	
 
 	// check for --send parameter
 	sendPtr := flag.Bool("send", false, "a bool")
 	pingPtr := flag.Bool("ping", false, "a bool")
-    cjdnsaddrPtr := flag.String("cjdnsaddr", "", "The cjdnsaddr to use.")
-    pubkeyPtr := flag.String("pubkey", "", "The pubkey to use.")
+    cjdnsaddrPtr := flag.String("cjdnsaddr", "", "The cjdnsaddr to use, derived from -pubkey if empty.")
+    pubkeyPtr := flag.String("pubkey", "", "The pubkey to use, looked up from -cjdnsaddr if empty.")
     amountPtr := flag.Int("amount", 0, "The amount to use.")
+	logLevelPtr := flag.String("cjdnslogs", "", "Stream cjdns logs of this level and above while listening.")
 
     // Parse the command line flags.
     flag.Parse()
 
+	if flag.NArg() > 0 {
+		err := runCommand(ctx, flag.Args())
+		if err != nil {
+			fmt.Println(err)
+		}
+		handlers.unregisterAll()
+		return
+	}
+
 	if *sendPtr {
 		sendCjdnsMessage(*cjdnsaddrPtr, *pubkeyPtr, *amountPtr)
 	} else {
+		logsDone := make(chan struct{})
+		if *logLevelPtr != "" {
+			go func() {
+				defer close(logsDone)
+				err := streamLogs(LogFilter{Level: *logLevelPtr}, func(lm LogMessage) {
+					fmt.Println(lm)
+				}, ctx.Done())
+				fmt.Println("cjdns log stream ended:", err)
+			}()
+		} else {
+			close(logsDone)
+		}
+		go func() {
+			<-ctx.Done()
+			<-logsDone
+			handlers.unregisterAll()
+			os.Exit(0)
+		}()
 		err := ListeningForInvoiceRequest(*cjdnsaddrPtr)
 		if err != nil {
 			fmt.Println(err)
+			handlers.unregisterAll()
 			return
 		}
 	}
@@ -410,5 +364,5 @@ func main() {
 	fmt.Println("Press enter to exit...")
 	fmt.Scanln()
 
-	unregisterHandler(udpPort)
+	handlers.unregisterAll()
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs a CLI subcommand such as "peers".
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "peers":
+		return peersCommand()
+	case "call":
+		return callCommand(args[1:])
+	case "logs":
+		return logsCommand(ctx, args[1:])
+	case "switchping":
+		return switchPingCommand(args[1:])
+	case "label":
+		return labelCommand(args[1:])
+	default:
+		return errors.New("unknown command " + args[0])
+	}
+}
+
+func peersCommand() error {
+	peers, err := peerStats()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBKEY\tLABEL\tVER\tSTATE\tDIR\tKBPS IN\tKBPS OUT\tBYTES IN\tBYTES OUT\tDUP\tLOST\tOOR\tLAST SEEN")
+	for _, p := range peers {
+		dir := "out"
+		if p.IsIncoming != 0 {
+			dir = "in"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			p.PublicKey, p.SwitchLabel, p.Version, p.State, dir, p.RecvKbps, p.SendKbps,
+			p.BytesIn, p.BytesOut, p.Duplicates, p.LostPackets, p.ReceivedOutOfRange,
+			time.Since(p.LastSeen()).Round(time.Millisecond))
+	}
+	return w.Flush()
+}
+
+func callCommand(args []string) error {
+	if cjdns.Admin == nil {
+		return errors.New("CJDNS connection is nil")
+	}
+	if len(args) == 0 {
+		return errors.New("usage: call <function> [name=value ...]")
+	}
+	functions, err := cjdns.Admin.AvailableFunctions()
+	if err != nil {
+		return err
+	}
+	fn, ok := functions[args[0]]
+	if !ok {
+		return errors.New("unknown admin function " + args[0])
+	}
+	callArgs, err := parseCallArgs(fn, args[1:])
+	if err != nil {
+		return err
+	}
+	response, err := cjdns.Admin.Call(args[0], callArgs)
+	if response == nil {
+		return err
+	}
+	delete(response, "txid")
+	out, jsonErr := json.MarshalIndent(response, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	fmt.Println(string(out))
+	return err
+}
+
+// logsCommand streams the cjdns log, filtered by level=, file= and line=,
+// until ctx is canceled.
+func logsCommand(ctx context.Context, args []string) error {
+	var filter LogFilter
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		switch name {
+		case "level":
+			filter.Level = strings.ToUpper(value)
+		case "file":
+			filter.File = value
+		case "line":
+			line, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad line %q: %v", value, err)
+			}
+			filter.Line = line
+		default:
+			return errors.New("usage: logs [level=DEBUG|INFO|WARN|ERROR|CRITICAL] [file=name] [line=n]")
+		}
+	}
+	return streamLogs(filter, func(lm LogMessage) {
+		fmt.Println(lm)
+	}, ctx.Done())
+}
+
+// switchPingCommand pings a switch label, "switchping <label> [key]".
+func switchPingCommand(args []string) error {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "key") {
+		return errors.New("usage: switchping <label> [key]")
+	}
+	label, err := ParseLabel(args[0])
+	if err != nil {
+		return err
+	}
+	pong, err := SwitchPing(label, len(args) == 2, switchPingTimeout)
+	if err != nil {
+		return err
+	}
+	if pong.Key != "" {
+		fmt.Printf("%s version %d key %s time %s\n", args[0], pong.Version, pong.Key, pong.RTT)
+	} else {
+		fmt.Printf("%s version %d time %s\n", args[0], pong.Version, pong.RTT)
+	}
+	return nil
+}
+
+const labelUsage = "usage: label explain <label> [scheme=<hex>|node=<ip>] [to=<hex>]"
+
+// labelCommand prints the per-hop directors of a label. Every hop is read
+// with the same scheme, v358 unless another is given.
+func labelCommand(args []string) error {
+	if len(args) < 2 || args[0] != "explain" {
+		return errors.New(labelUsage)
+	}
+	label, err := ParseLabel(args[1])
+	if err != nil {
+		return err
+	}
+	scheme := SchemeV358
+	var to EncodingScheme
+	for _, arg := range args[2:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return errors.New(labelUsage)
+		}
+		switch kv[0] {
+		case "scheme", "to":
+			raw, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return fmt.Errorf("bad scheme %q: %v", kv[1], err)
+			}
+			es, err := DecodeEncodingScheme(raw)
+			if err != nil {
+				return err
+			}
+			if kv[0] == "to" {
+				to = es
+			} else {
+				scheme = es
+			}
+		case "node":
+			node, err := nodeForAddr(kv[1])
+			if err != nil {
+				return err
+			}
+			if err := node.EncodingScheme.Validate(); err != nil {
+				return err
+			}
+			scheme = node.EncodingScheme
+		default:
+			return errors.New(labelUsage)
+		}
+	}
+	hops, err := scheme.Directors(label)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s scheme %s (%x)\n", label, scheme, scheme.Serialize())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tDIRECTOR\tFORM\tBITS")
+	for i, hop := range hops {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", i, hop.Director, hop.Form, hop.Bits)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if to != nil {
+		converted, err := ConvertLabel(label, scheme, to)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("as %s: %s\n", to, converted)
+	}
+	return nil
+}
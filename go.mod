@@ -2,10 +2,13 @@ module cjdns_bridge
 
 go 1.18
 
+require (
+	github.com/google/gopacket v1.1.19
+	github.com/zeebo/bencode v1.0.0
+)
+
 require (
 	github.com/IncSW/go-bencode v0.2.2 // indirect
-	github.com/google/gopacket v1.1.19 // indirect
-	github.com/zeebo/bencode v1.0.0 // indirect
 	golang.org/x/net v0.14.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
 )